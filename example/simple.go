@@ -5,10 +5,16 @@
 package main
 
 import (
+        "flag"
+        "fmt"
         "go-fastweb.googlecode.com/svn/trunk/src/fastweb"
+        "go-fastweb.googlecode.com/svn/trunk/src/signals"
         "os"
 )
 
+var standalone = flag.Bool("http", false, "serve plain HTTP, including htdocs, instead of FastCGI")
+var verify = flag.Bool("verify", false, "check the views against the controllers and exit")
+
 type Products struct {
 	fastweb.Controller
 	Name string
@@ -39,8 +45,31 @@ func (p *Products) View(id string) os.Error {
 }
 
 func main() {
+	flag.Parse()
 	a := fastweb.NewApplication()
 	a.RegisterController(&Products{})
+	if *verify {
+		errs := a.Verify()
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	signals.Handle(a)
+	if *standalone {
+		a.ServeStatic("/css/", "htdocs/css")
+		a.ServeStatic("/img/", "htdocs/img")
+		a.WatchViews(1e9)
+		a.RunHTTP(":12345")
+		return
+	}
+	if e := a.PreloadViews(); e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(1)
+	}
         a.Run(":12345")
 }
 
@@ -0,0 +1,91 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"http"
+	"strings"
+	"time"
+)
+
+// conditional is implemented by Controller.  route uses it to answer
+// conditional requests with 304 Not Modified.
+type conditional interface {
+	notModified() bool
+	notModifiedBody() bool
+}
+
+// SetETag sets the ETag of the response.  tag is quoted unless it is
+// already, as in "xyz" or W/"xyz".
+func (c *Controller) SetETag(tag string) {
+	if !strings.HasPrefix(tag, "\"") && !strings.HasPrefix(tag, "W/\"") {
+		tag = "\"" + tag + "\""
+	}
+	c.Response.Header().Set("ETag", tag)
+}
+
+// SetETagFromBody makes the ETag of the response a digest of the rendered
+// output, computed once the controller has rendered.  The body is still
+// rendered for every request, but not sent when the client has it.
+func (c *Controller) SetETagFromBody() {
+	c.bodyETag = true
+}
+
+// SetLastModified sets the Last-Modified time of the response.
+func (c *Controller) SetLastModified(t *time.Time) {
+	c.Response.Header().Set("Last-Modified", time.SecondsToUTC(t.Seconds()).Format(http.TimeFormat))
+}
+
+// SetCacheControl sets the Cache-Control header of the response to
+// directives, e.g. c.SetCacheControl("public", "max-age=3600").
+func (c *Controller) SetCacheControl(directives ...string) {
+	c.Response.Header().Set("Cache-Control", strings.Join(directives, ", "))
+}
+
+// NotModified reports whether the client has the current version of the
+// response, according to the ETag and Last-Modified set so far.  In that
+// case the framework answers 304 Not Modified without rendering; actions
+// can call it after setting a cheap validator to skip the rest of their
+// work.
+func (c *Controller) NotModified() bool {
+	return c.notModified()
+}
+
+func (c *Controller) notModified() bool {
+	if c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+		return false
+	}
+	if c.out.committed || c.out.status != 0 && c.out.status != http.StatusOK ||
+		c.Status != 0 && c.Status != http.StatusOK {
+		return false
+	}
+
+	h := c.Response.Header()
+	etag := h.Get("ETag")
+	var mtime int64
+	if lm := h.Get("Last-Modified"); lm != "" {
+		if t, e := time.Parse(http.TimeFormat, lm); e == nil {
+			mtime = t.Seconds()
+		}
+	}
+	if etag == "" && mtime == 0 {
+		return false
+	}
+	return notModified(c.Request, etag, mtime)
+}
+
+// notModifiedBody sets the ETag from the rendered output if the controller
+// asked for it, and then checks the validators again.
+func (c *Controller) notModifiedBody() bool {
+	if !c.bodyETag || c.out.committed {
+		return false
+	}
+	h := sha1.New()
+	h.Write(c.out.buf.Bytes())
+	c.SetETag(hex.EncodeToString(h.Sum()))
+	return c.notModified()
+}
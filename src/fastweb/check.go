@@ -0,0 +1,315 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ViewError is an error found in a view, when it is loaded or checked.
+type ViewError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ViewError) String() string { return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg) }
+
+// Types of the loop variables of .repeated sections.  @key can be anything.
+var loopVarTypes = map[string]reflect.Type{
+	"index":  reflect.TypeOf(0),
+	"key":    nil,
+	"first":  reflect.TypeOf(false),
+	"last":   reflect.TypeOf(false),
+	"odd":    reflect.TypeOf(false),
+	"even":   reflect.TypeOf(false),
+	"length": reflect.TypeOf(0),
+}
+
+// A scope of the views being checked: the type of the data at a section,
+// nil when it can't be told.
+type checkScope struct {
+	parent *checkScope
+	typ    reflect.Type
+	loop   bool // at an item of a .repeated section
+}
+
+type checker struct {
+	errs []os.Error
+}
+
+func (ck *checker) errorf(file string, line int, format string, args ...interface{}) {
+	ck.errs = append(ck.errs, &ViewError{file, line, fmt.Sprintf(format, args...)})
+}
+
+// CheckViews verifies the views of the controller c: those under
+// <controller>/ and <controller>/elements/ in the views root.  Besides syntax
+// errors, like unbalanced sections and unknown formatters or functions,
+// it reports names not found in the controller type and the types of the
+// sections they are in.  Names in data of interface types are not checked.
+func (a *Application) CheckViews(c ControllerInterface) []os.Error {
+	v := reflect.ValueOf(c)
+	lname := deTitleCase(v.Elem().Type().Name())
+	ck := new(checker)
+	for _, dir := range []string{lname, lname + "/elements"} {
+		names, e := viewNames(a.fs, a.viewsRoot+"/"+dir)
+		if e != nil {
+			continue
+		}
+		for _, name := range names {
+			fname := a.viewPath(dir + "/" + name)
+			t, e := a.loadTemplate(fname)
+			if e != nil {
+				if _, ok := e.(*ViewError); !ok {
+					e = &ViewError{fname, 0, e.String()}
+				}
+				ck.errs = append(ck.errs, e)
+				continue
+			}
+			ck.walk(t, 0, len(t.elems), &checkScope{typ: v.Type()}, t.blocks)
+		}
+	}
+	return ck.errs
+}
+
+// Verify checks the views of all the registered controllers.
+func (a *Application) Verify() []os.Error {
+	var errs []os.Error
+	names := make([]string, 0, len(a.controllerMap))
+	for name := range a.controllerMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, a.CheckViews(a.controllerMap[name].controller)...)
+	}
+	return errs
+}
+
+// viewNames returns the names of the views in dir of fs, without ".tpl".
+func viewNames(fs FileSystem, dir string) ([]string, os.Error) {
+	f, e := fs.Open(dir)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	fis, e := f.Readdir(-1)
+	if e != nil {
+		return nil, e
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name, ".tpl") && !strings.HasPrefix(fi.Name, ".") && !fi.IsDirectory() {
+			names = append(names, fi.Name[0:len(fi.Name)-4])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// logViewErrors logs the errors of CheckViews, when the application checks
+// views at RegisterController.
+func logViewErrors(errs []os.Error) {
+	for _, e := range errs {
+		log.Printf("%s", e.String())
+	}
+}
+
+// walk checks the elements start to end of t.
+func (ck *checker) walk(t *Template, start, end int, sc *checkScope, blocks map[string]*blockRef) {
+	for i := start; i < end; {
+		switch elem := t.elems[i].(type) {
+		case *variableElement:
+			for _, arg := range elem.args {
+				switch arg := arg.(type) {
+				case fieldName:
+					ck.name(t, elem.linenum, string(arg), sc)
+				case *exprArg:
+					ck.expr(t, elem.linenum, arg.x, sc)
+				}
+			}
+		case *sectionElement:
+			typ := ck.name(t, elem.linenum, elem.field, sc)
+			end := elem.end
+			if elem.or >= 0 {
+				end = elem.or
+				ck.walk(t, elem.or, elem.end, sc, blocks)
+			}
+			ck.walk(t, elem.start, end, &checkScope{sc, typ, false}, blocks)
+			i = elem.end
+			continue
+		case *repeatedElement:
+			typ := ck.name(t, elem.linenum, elem.field, sc)
+			item := &checkScope{sc, itemType(typ), true}
+			end := elem.end
+			if elem.or >= 0 {
+				end = elem.or
+				ck.walk(t, elem.or, elem.end, sc, blocks)
+			}
+			if elem.altstart >= 0 {
+				end = elem.altstart
+				ck.walk(t, elem.altstart, elem.altend, item, blocks)
+			}
+			ck.walk(t, elem.start, end, item, blocks)
+			i = elem.end
+			continue
+		case *ifElement:
+			for _, cond := range elem.conds {
+				if cond != nil {
+					ck.expr(t, elem.linenum, cond, sc)
+				}
+			}
+			ck.walk(t, elem.starts[0], elem.end, sc, blocks)
+			i = elem.end
+			continue
+		case *blockElement:
+			if ref := blocks[elem.name]; ref != nil {
+				ck.walk(ref.t, ref.start, ref.end, sc, blocks)
+			} else {
+				ck.walk(t, elem.start, elem.end, sc, blocks)
+			}
+			i = elem.end
+			continue
+		case *includeElement:
+			typ := sc.typ
+			if elem.arg != nil {
+				typ = ck.expr(t, elem.linenum, elem.arg, sc)
+			}
+			if it := elem.tmpl; it != nil {
+				ck.walk(it, 0, len(it.elems), &checkScope{sc, typ, false}, it.blocks)
+			}
+		}
+		i++
+	}
+}
+
+// itemType returns the type of the items repeated over typ, nil if it
+// can't be told.
+func itemType(typ reflect.Type) reflect.Type {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil {
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return typ.Elem()
+	}
+	return nil
+}
+
+// name returns the type of the name in sc, reporting an error if it isn't
+// there.
+func (ck *checker) name(t *Template, line int, name string, sc *checkScope) reflect.Type {
+	for s := sc; s != nil; s = s.parent {
+		if s.typ == nil {
+			return nil
+		}
+		if typ, ok := s.lookup(name); ok {
+			return typ
+		}
+	}
+	if name[0] == '@' {
+		ck.errorf(t.file, line, "%s outside a .repeated section", name)
+	} else {
+		ck.errorf(t.file, line, "name not found: %s in type %s", name, sc.typ)
+	}
+	return nil
+}
+
+// lookup returns the type of name in s, as findVar resolves it.
+func (s *checkScope) lookup(name string) (reflect.Type, bool) {
+	name = strings.TrimLeft(name, "*")
+	if name == "@" {
+		return s.typ, true
+	}
+	if name[0] == '@' {
+		typ, ok := loopVarTypes[name[1:]]
+		return typ, ok && s.loop
+	}
+	typ := s.typ
+	for _, elem := range strings.Split(name, ".") {
+		var ok bool
+		if typ, ok = lookupType(typ, elem); !ok {
+			return nil, false
+		}
+		if typ == nil {
+			return nil, true
+		}
+	}
+	return typ, true
+}
+
+// lookupType returns the type of the field, method or map element name of
+// typ, as lookup finds it.  It returns a nil type if that can't be told.
+func lookupType(typ reflect.Type, name string) (reflect.Type, bool) {
+	for typ != nil {
+		parts := strings.SplitN(name, ":", 2)
+		nIn := len(parts)
+		if typ.Kind() != reflect.Interface {
+			for i := 0; i < typ.NumMethod(); i++ {
+				m := typ.Method(i)
+				if m.Name == parts[0] && m.Type.NumIn() == nIn && m.Type.NumOut() == 1 {
+					return m.Type.Out(0), true
+				}
+			}
+		}
+		switch typ.Kind() {
+		case reflect.Ptr:
+			typ = typ.Elem()
+		case reflect.Interface:
+			return nil, true
+		case reflect.Struct:
+			if f, ok := typ.FieldByName(name); ok {
+				return f.Type, true
+			}
+			return nil, false
+		case reflect.Map:
+			return typ.Elem(), true
+		default:
+			return nil, false
+		}
+	}
+	return nil, true
+}
+
+var boolType = reflect.TypeOf(false)
+
+// expr checks the names and calls in the expression x and returns its
+// type.
+func (ck *checker) expr(t *Template, line int, x interface{}, sc *checkScope) reflect.Type {
+	switch x := x.(type) {
+	case *exprLiteral:
+		if x.val.IsValid() {
+			return x.val.Type()
+		}
+	case *exprField:
+		return ck.name(t, line, x.name, sc)
+	case *exprNot:
+		ck.expr(t, line, x.x, sc)
+		return boolType
+	case *exprBinary:
+		ck.expr(t, line, x.x, sc)
+		ck.expr(t, line, x.y, sc)
+		return boolType
+	case *exprCall:
+		for _, arg := range x.args {
+			ck.expr(t, line, arg, sc)
+		}
+		typ := x.fn.Type()
+		n := typ.NumIn()
+		if typ.IsVariadic() && len(x.args) < n-1 || !typ.IsVariadic() && len(x.args) != n {
+			ck.errorf(t.file, line, "wrong number of arguments in call of %s: %d", x.name, len(x.args))
+		}
+		return typ.Out(0)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"http"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The types compressed when EnableCompression is given none.
+var defaultCompressTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// Types whose content is compressed already, and is never compressed again
+// even when an allowed prefix matches.
+var compressedTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"audio/",
+	"video/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-compress",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+	"font/woff",
+	"font/woff2",
+	"application/font-woff",
+}
+
+type compressConfig struct {
+	minSize int
+	types   []string
+}
+
+// EnableCompression turns on gzip/deflate compression of controller output
+// for clients that accept it.  Responses shorter than minSize bytes are
+// sent as they are.  types lists the content types that are compressed; a
+// type ending with "/" matches all its subtypes.  Without types, text and
+// the common textual application types are compressed.
+func (a *Application) EnableCompression(minSize int, types ...string) {
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	a.compress = &compressConfig{
+		minSize: minSize,
+		types:   types,
+	}
+}
+
+func matchType(ct string, types []string) bool {
+	for _, t := range types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(ct, t) || ct == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *compressConfig) compressible(ct string) bool {
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[0:i]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	return matchType(ct, cc.types) && !matchType(ct, compressedTypes)
+}
+
+// acceptEncoding picks the content coding to use from an Accept-Encoding
+// header, "" if none of gzip and deflate is acceptable.
+func acceptEncoding(s string) string {
+	var gz, defl, any float64 = -1, -1, -1
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, e := strconv.Atof64(p[2:]); e == nil {
+					q = v
+				}
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			gz = q
+		case "deflate":
+			defl = q
+		case "*":
+			any = q
+		}
+	}
+	if gz < 0 {
+		gz = any
+	}
+	if defl < 0 {
+		defl = any
+	}
+	switch {
+	case gz > 0 && gz >= defl:
+		return "gzip"
+	case defl > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter compresses what is written to it, once the content type is
+// known to be compressible and at least minSize bytes have been written.
+// Until then the status and the output are held back.
+type compressWriter struct {
+	w        ResponseWriter
+	cc       *compressConfig
+	encoding string
+	head     bool
+	status   int
+	buf      bytes.Buffer
+	decided  bool
+	cw       io.WriteCloser
+}
+
+func newCompressWriter(w ResponseWriter, r *Request, cc *compressConfig) *compressWriter {
+	return &compressWriter{
+		w:        w,
+		cc:       cc,
+		encoding: acceptEncoding(r.Header.Get("Accept-Encoding")),
+		head:     r.Method == "HEAD",
+	}
+}
+
+func (c *compressWriter) Header() http.Header { return c.w.Header() }
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, os.Error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		if c.cw != nil {
+			return c.cw.Write(b)
+		}
+		return c.w.Write(b)
+	}
+	c.buf.Write(b)
+	if c.buf.Len() >= c.cc.minSize {
+		if e := c.decide(true); e != nil {
+			return 0, e
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the header, compressing the output if big is set and the
+// response qualifies, and then what was held back.
+func (c *compressWriter) decide(big bool) os.Error {
+	c.decided = true
+	h := c.w.Header()
+	ok := c.cc.compressible(h.Get("Content-Type")) && h.Get("Content-Encoding") == ""
+	if ok {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if ok && big && c.encoding != "" && !c.head &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		var e os.Error
+		if c.encoding == "gzip" {
+			c.cw, e = gzip.NewWriter(c.w)
+		} else {
+			c.cw, e = zlib.NewWriter(c.w)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	c.w.WriteHeader(c.status)
+	var e os.Error
+	if c.cw != nil {
+		_, e = c.cw.Write(c.buf.Bytes())
+	} else {
+		_, e = c.w.Write(c.buf.Bytes())
+	}
+	c.buf.Reset()
+	return e
+}
+
+// close sends what is still held back and finishes the compressed stream.
+func (c *compressWriter) close() os.Error {
+	if c.status == 0 {
+		return nil
+	}
+	if !c.decided {
+		if e := c.decide(false); e != nil {
+			return e
+		}
+	}
+	if c.cw != nil {
+		return c.cw.Close()
+	}
+	return nil
+}
+
+// Flush sends what is held back, deciding on compression with what has been
+// written so far, and flushes the compressor and the underlying writer.
+func (c *compressWriter) Flush() {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.decided {
+		if e := c.decide(c.buf.Len() >= c.cc.minSize); e != nil {
+			return
+		}
+	}
+	if f, ok := c.cw.(interface {
+		Flush() os.Error
+	}); ok {
+		f.Flush()
+	}
+	if f, ok := c.w.(flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,806 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"json"
+	"path"
+	"strings"
+	"url"
+)
+
+// SafeHTML is markup from a trusted source.  Variables of this type are
+// written as they are in the text of an HTML template, where others are
+// escaped.
+type SafeHTML string
+
+// Escaping modes of templates.  A template in mode EscapeHTML escapes each
+// variable according to where it stands in the HTML: element text,
+// attribute values, URLs, scripts and style sheets.  EscapeJS and EscapeCSS
+// start in a script and a style sheet respectively.  Variables with the
+// raw formatter are never escaped.
+const (
+	EscapeNone = iota
+	EscapeHTML
+	EscapeJS
+	EscapeCSS
+)
+
+// EscapeModes maps the extension a view has before ".tpl" to its escaping
+// mode; the entry for "" is used for views without one, or with one not
+// listed.  For example views/feed/index.xml.tpl is looked up as ".xml".
+var EscapeModes = map[string]int{
+	"":      EscapeHTML,
+	".html": EscapeHTML,
+	".xml":  EscapeHTML,
+	".js":   EscapeJS,
+	".json": EscapeJS,
+	".css":  EscapeCSS,
+	".txt":  EscapeNone,
+}
+
+// escapeMode returns the escaping mode of the view fname.
+func escapeMode(fname string) int {
+	if strings.HasSuffix(fname, ".tpl") {
+		fname = fname[0 : len(fname)-4]
+	}
+	ext := path.Ext(fname)
+	if mode, ok := EscapeModes[ext]; ok {
+		return mode
+	}
+	return EscapeModes[""]
+}
+
+// Kinds of escaping contexts.
+const (
+	ctxNone = iota
+	ctxHTML
+	ctxURL      // start of a URL
+	ctxURLPath  // within a URL, before the query
+	ctxURLQuery // query or fragment of a URL
+	ctxJS
+	ctxJSStr
+	ctxJSRegexp
+	ctxCSS
+	ctxCSSStr
+)
+
+// Placement of a context within a tag.
+const (
+	attrNone = iota
+	attrQuoted
+	attrUnquoted
+)
+
+// escContext tells how the output of a variable is escaped.
+type escContext struct {
+	kind uint8
+	attr uint8
+}
+
+// States of the HTML scanner.
+const (
+	stText = iota
+	stComment
+	stTagName
+	stTag
+	stAttrName
+	stAfterName
+	stBeforeValue
+	stAttr
+)
+
+// Kinds of attribute values.
+const (
+	valPlain = iota
+	valURL
+	valJS
+	valCSS
+)
+
+var urlAttrs = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"codebase":   true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"icon":       true,
+	"longdesc":   true,
+	"manifest":   true,
+	"poster":     true,
+	"src":        true,
+	"usemap":     true,
+}
+
+// escState follows the text of a template through HTML, so that variables
+// know the context they are written in.  Each branch of a section is
+// followed from the state the section starts in.
+type escState struct {
+	state   uint8
+	tag     []byte // name of the tag being scanned
+	closing bool   // the tag is an end tag
+	element string // "script", "style", "textarea" or "title" while in one
+	name    []byte // name of the attribute being scanned
+	val     uint8  // kind of the attribute value
+	delim   byte   // quote around the attribute value, 0 if unquoted
+	urlPart uint8  // ctxURL, ctxURLPath or ctxURLQuery
+	code    codeState
+}
+
+// Comments of scripts and style sheets.
+const (
+	cmtNone = iota
+	cmtLine
+	cmtBlock
+)
+
+// Regular expression literals of scripts.
+const (
+	reNone = iota
+	reLiteral
+	reClass // within [] in a literal
+)
+
+// codeState follows a script or a style sheet: its strings, its comments,
+// and in scripts regular expressions, which a '/' starts where a division
+// can't stand.
+type codeState struct {
+	str    byte   // quote of the string being scanned
+	bslash bool   // the previous character in a string or regexp is a backslash
+	cmt    uint8  // comment being scanned
+	star   bool   // the previous character in a block comment is a '*'
+	re     uint8  // regular expression being scanned
+	slash  bool   // a '/' was just read, which may start a comment
+	divide bool   // a '/' here is a division
+	last   byte   // a '+' or '-' just read, which may end x++ or x--
+	ident  bool   // an identifier or a value is being read
+	word   string // the identifier being read, while it may be a keyword
+}
+
+// Keywords after which a '/' starts a regular expression.
+var regexpKeywords = map[string]bool{
+	"break":      true,
+	"case":       true,
+	"continue":   true,
+	"delete":     true,
+	"do":         true,
+	"else":       true,
+	"finally":    true,
+	"in":         true,
+	"instanceof": true,
+	"return":     true,
+	"throw":      true,
+	"try":        true,
+	"typeof":     true,
+	"void":       true,
+}
+
+func isJSIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '$' || c >= 0x80
+}
+
+func newEscState(mode int) *escState {
+	s := new(escState)
+	switch mode {
+	case EscapeJS:
+		s.element = "script"
+	case EscapeCSS:
+		s.element = "style"
+	}
+	return s
+}
+
+// clone returns a copy of s that scans independently of it.
+func (s *escState) clone() *escState {
+	c := *s
+	c.tag = append([]byte(nil), s.tag...)
+	c.name = append([]byte(nil), s.name...)
+	return &c
+}
+
+// equal tells whether s and o give the same contexts to whatever text
+// follows.  Fields the state of s doesn't use are ignored.
+func (s *escState) equal(o *escState) bool {
+	if s.state != o.state || s.element != o.element {
+		return false
+	}
+	switch s.state {
+	case stText:
+		if s.element == "script" || s.element == "style" {
+			return s.code == o.code
+		}
+		return true
+	case stComment:
+		return true
+	}
+	if s.closing != o.closing || string(s.tag) != string(o.tag) {
+		return false
+	}
+	switch s.state {
+	case stAttrName, stAfterName, stBeforeValue:
+		return string(s.name) == string(o.name)
+	case stAttr:
+		if s.val != o.val || s.delim != o.delim {
+			return false
+		}
+		switch s.val {
+		case valURL:
+			return s.urlPart == o.urlPart
+		case valJS, valCSS:
+			return s.code == o.code
+		}
+	}
+	return true
+}
+
+// reconciles tells whether text scanned as if s were o is escaped safely:
+// either they are equal, or o is at the start of the same URL, where
+// variables are checked the most.
+func (s *escState) reconciles(o *escState) bool {
+	if s.state == stAttr && s.val == valURL && o.val == valURL && o.urlPart == ctxURL {
+		u := s.clone()
+		u.urlPart = ctxURL
+		return u.equal(o)
+	}
+	return s.equal(o)
+}
+
+// scanCode advances the code state over c, in a style sheet if css is
+// set, in a script otherwise.
+func (s *escState) scanCode(c byte, css bool) {
+	js := &s.code
+	if js.slash {
+		js.slash = false
+		switch {
+		case c == '*':
+			js.cmt = cmtBlock
+			js.star = false
+			return
+		case c == '/' && !css:
+			js.cmt = cmtLine
+			return
+		case !css && !js.divide:
+			// c is the first character of the expression
+			js.re = reLiteral
+		default:
+			js.divide = false
+		}
+	}
+	switch {
+	case js.cmt == cmtLine:
+		if c == '\n' || c == '\r' {
+			js.cmt = cmtNone
+		}
+		return
+	case js.cmt == cmtBlock:
+		if js.star && c == '/' {
+			js.cmt = cmtNone
+		}
+		js.star = c == '*'
+		return
+	case js.re != reNone:
+		switch {
+		case js.bslash:
+			js.bslash = false
+		case c == '\\':
+			js.bslash = true
+		case c == '[':
+			js.re = reClass
+		case c == ']' && js.re == reClass:
+			js.re = reLiteral
+		case c == '/' && js.re == reLiteral:
+			js.re = reNone
+			js.divide = true
+			js.last = 0
+			js.ident = false
+			js.word = ""
+		}
+		return
+	case js.str != 0:
+		switch {
+		case js.bslash:
+			js.bslash = false
+		case c == '\\':
+			js.bslash = true
+		case c == js.str:
+			js.str = 0
+			js.divide = true
+			js.last = 0
+			js.ident = false
+			js.word = ""
+		}
+		return
+	case isSpace(c):
+		js.last = 0
+		js.ident = false
+		js.word = ""
+		return
+	case isJSIdentChar(c) && !css:
+		if !js.ident || js.word != "" {
+			js.word = keywordPrefix(js.word + string(c))
+		}
+		js.divide = !regexpKeywords[js.word]
+		js.last = 0
+		js.ident = true
+		return
+	}
+	switch {
+	case c == '"' || c == '\'' || c == '`' && !css:
+		js.str = c
+	case c == '/':
+		js.slash = true
+	case c == ')' || c == ']':
+		js.divide = true
+	case (c == '+' || c == '-') && js.last == c:
+		// after x++ or x--
+		js.divide = true
+	default:
+		js.divide = false
+	}
+	js.last = 0
+	if c == '+' || c == '-' {
+		js.last = c
+	}
+	js.ident = false
+	js.word = ""
+}
+
+// keywordPrefix returns word if it begins one of regexpKeywords, "" if
+// it can't be a keyword any more.
+func keywordPrefix(word string) string {
+	for k := range regexpKeywords {
+		if strings.HasPrefix(k, word) {
+			return word
+		}
+	}
+	return ""
+}
+
+// value advances the code state over a variable, and returns the context
+// it is written in: ctxJS or ctxCSS in code, that of the string,
+// regular expression or comment otherwise.
+func (s *escState) value(css bool) uint8 {
+	js := &s.code
+	if js.slash {
+		js.slash = false
+		if !css && !js.divide {
+			js.re = reLiteral
+		}
+	}
+	switch {
+	case js.cmt != cmtNone:
+		// escaped so as not to end the comment
+		js.star = false
+		if css {
+			return ctxCSSStr
+		}
+		return ctxJSStr
+	case js.re != reNone:
+		js.bslash = false
+		return ctxJSRegexp
+	case js.str != 0:
+		js.bslash = false
+		if css {
+			return ctxCSSStr
+		}
+		return ctxJSStr
+	}
+	js.divide = true
+	js.last = 0
+	js.ident = true
+	js.word = ""
+	if css {
+		return ctxCSS
+	}
+	return ctxJS
+}
+
+func isNameChar(c byte) bool {
+	return c != '>' && c != '/' && c != '=' && !isSpace(c)
+}
+
+// scan advances the state over text written as it is.
+func (s *escState) scan(text []byte) {
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch s.state {
+		case stText:
+			if s.element != "" {
+				if c == '<' && i+1 < len(text) && text[i+1] == '/' &&
+					bytes.HasPrefix(bytes.ToLower(text[i+2:]), []byte(s.element)) {
+					s.element = ""
+					s.code = codeState{}
+					s.state = stTagName
+					s.tag = s.tag[0:0]
+					s.closing = true
+					i += 2
+					continue
+				}
+				if s.element == "script" || s.element == "style" {
+					s.scanCode(c, s.element == "style")
+				}
+			} else if c == '<' {
+				switch {
+				case bytes.HasPrefix(text[i:], []byte("<!--")):
+					s.state = stComment
+					i += 4
+					continue
+				case i+1 < len(text) && text[i+1] == '/':
+					s.state = stTagName
+					s.tag = s.tag[0:0]
+					s.closing = true
+					i += 2
+					continue
+				case i+1 < len(text) && (text[i+1]|0x20 >= 'a' && text[i+1]|0x20 <= 'z'):
+					s.state = stTagName
+					s.tag = s.tag[0:0]
+					s.closing = false
+				}
+			}
+		case stComment:
+			if bytes.HasPrefix(text[i:], []byte("-->")) {
+				s.state = stText
+				i += 3
+				continue
+			}
+		case stTagName:
+			if isNameChar(c) {
+				s.tag = append(s.tag, c|0x20)
+			} else {
+				s.state = stTag
+				continue
+			}
+		case stTag:
+			switch {
+			case c == '>':
+				s.state = stText
+				if !s.closing {
+					switch t := string(s.tag); t {
+					case "script", "style", "textarea", "title":
+						s.element = t
+						s.code = codeState{}
+					}
+				}
+			case isNameChar(c):
+				s.state = stAttrName
+				s.name = s.name[0:0]
+				continue
+			}
+		case stAttrName:
+			if isNameChar(c) {
+				s.name = append(s.name, c|0x20)
+			} else {
+				s.state = stAfterName
+				continue
+			}
+		case stAfterName:
+			switch {
+			case c == '=':
+				s.state = stBeforeValue
+			case !isSpace(c):
+				s.state = stTag
+				continue
+			}
+		case stBeforeValue:
+			if isSpace(c) {
+				break
+			}
+			if c == '>' {
+				s.state = stTag
+				continue
+			}
+			s.beginValue()
+			if c == '"' || c == '\'' {
+				s.delim = c
+			} else {
+				s.delim = 0
+				continue
+			}
+		case stAttr:
+			if s.delim != 0 && c == s.delim || s.delim == 0 && (c == '>' || isSpace(c)) {
+				s.state = stTag
+				if s.delim == 0 {
+					continue
+				}
+				break
+			}
+			switch s.val {
+			case valURL:
+				if c == '?' || c == '#' {
+					s.urlPart = ctxURLQuery
+				} else if s.urlPart == ctxURL {
+					s.urlPart = ctxURLPath
+				}
+			case valJS, valCSS:
+				s.scanCode(c, s.val == valCSS)
+			}
+		}
+		i++
+	}
+}
+
+func (s *escState) beginValue() {
+	s.state = stAttr
+	s.code = codeState{}
+	name := string(s.name)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		s.val = valJS
+	case name == "style":
+		s.val = valCSS
+	case urlAttrs[name]:
+		s.val = valURL
+		s.urlPart = ctxURL
+	default:
+		s.val = valPlain
+	}
+}
+
+// context returns the escaping context of a variable at the current point,
+// and moves past it.  A variable right after "=" starts an unquoted
+// attribute value.
+func (s *escState) context() escContext {
+	switch s.state {
+	case stText:
+		switch s.element {
+		case "script":
+			return escContext{s.value(false), attrNone}
+		case "style":
+			return escContext{s.value(true), attrNone}
+		}
+		return escContext{ctxHTML, attrNone}
+	case stComment:
+		return escContext{ctxHTML, attrNone}
+	case stAttr, stBeforeValue:
+		attr := uint8(attrQuoted)
+		if s.state == stBeforeValue || s.delim == 0 {
+			attr = attrUnquoted
+		}
+		if s.state == stBeforeValue {
+			s.beginValue()
+			s.delim = 0
+		}
+		switch s.val {
+		case valURL:
+			part := s.urlPart
+			if part == ctxURL {
+				// what follows the variable is past the scheme
+				s.urlPart = ctxURLPath
+			}
+			return escContext{part, attr}
+		case valJS:
+			return escContext{s.value(false), attr}
+		case valCSS:
+			return escContext{s.value(true), attr}
+		}
+		return escContext{ctxHTML, attr}
+	}
+	// in a tag, between attributes
+	return escContext{ctxHTML, attrUnquoted}
+}
+
+// escapes tells which context the output of a builtin formatter is already
+// escaped for.  Formatters of the same names given in a FormatterMap are
+// escaped like any other.
+var escapes = map[string]uint8{
+	"attr":     ctxHTML,
+	"css":      ctxCSS,
+	"html":     ctxHTML,
+	"js":       ctxJSStr,
+	"json":     ctxJS,
+	"nl2br":    ctxHTML,
+	"url":      ctxURL,
+	"urlquery": ctxURLQuery,
+}
+
+// escape writes b to w, escaped for c.
+func (c escContext) escape(w io.Writer, b []byte) {
+	if c.attr != attrNone && c.kind != ctxHTML {
+		var buf bytes.Buffer
+		escContext{c.kind, attrNone}.escape(&buf, b)
+		escContext{ctxHTML, c.attr}.escape(w, buf.Bytes())
+		return
+	}
+	switch c.kind {
+	case ctxHTML:
+		if c.attr == attrUnquoted {
+			attrEscape(w, b)
+		} else {
+			HTMLEscape(w, b)
+		}
+	case ctxURL:
+		if !safeURL(b) {
+			io.WriteString(w, "#ZfastwebZ")
+			return
+		}
+		urlNormalize(w, b)
+	case ctxURLPath:
+		urlNormalize(w, b)
+	case ctxURLQuery:
+		io.WriteString(w, url.QueryEscape(string(b)))
+	case ctxJS:
+		io.WriteString(w, "\"")
+		jsStrEscape(w, b)
+		io.WriteString(w, "\"")
+	case ctxJSStr:
+		jsStrEscape(w, b)
+	case ctxJSRegexp:
+		jsRegexpEscape(w, b)
+	case ctxCSS:
+		cssValueFilter(w, b)
+	case ctxCSSStr:
+		cssStrEscape(w, b)
+	default:
+		w.Write(b)
+	}
+}
+
+// jsValue writes v to w as a JavaScript value, for variables in scripts
+// without formatters and for the json formatter.
+func jsValue(w io.Writer, v interface{}) {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	b, e := json.Marshal(v)
+	if e != nil {
+		io.WriteString(w, "null")
+		return
+	}
+	// keep </script> and the like out of the output; <, > and & only
+	// appear in strings
+	last := 0
+	for i, c := range b {
+		if c == '<' || c == '>' || c == '&' {
+			w.Write(b[last:i])
+			fmt.Fprintf(w, "\\u%04x", c)
+			last = i + 1
+		}
+	}
+	w.Write(b[last:])
+}
+
+// attrEscape escapes b for an unquoted attribute value.
+func attrEscape(w io.Writer, b []byte) {
+	last := 0
+	for i, c := range b {
+		switch c {
+		case '"', '\'', '&', '<', '>', '=', '`', ' ', '\t', '\n', '\r', '\f':
+		default:
+			continue
+		}
+		w.Write(b[last:i])
+		fmt.Fprintf(w, "&#%d;", c)
+		last = i + 1
+	}
+	w.Write(b[last:])
+}
+
+// safeURL reports whether the URL b is relative or has a scheme that
+// can't run code.
+func safeURL(b []byte) bool {
+	for i, c := range b {
+		switch c {
+		case '/', '?', '#':
+			return true
+		case ':':
+			switch strings.ToLower(strings.TrimSpace(string(b[0:i]))) {
+			case "http", "https", "mailto":
+				return true
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// urlNormalize percent-encodes the bytes of b that can't appear in a URL,
+// leaving the ones that can, including '%', as they are.
+func urlNormalize(w io.Writer, b []byte) {
+	last := 0
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexRune("-._~:/?#[]@!$&'()*+,;=%", int(c)) >= 0 {
+			continue
+		}
+		w.Write(b[last:i])
+		fmt.Fprintf(w, "%%%02X", c)
+		last = i + 1
+	}
+	w.Write(b[last:])
+}
+
+// jsStrEscape escapes b for a JavaScript string literal, quoted with any of
+// the three kinds of quote, within a script element.
+func jsStrEscape(w io.Writer, b []byte) {
+	last := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		var esc string
+		switch {
+		case c == '\\' || c == '\'' || c == '"' || c == '`' || c == '/':
+			esc = "\\" + string(c)
+		case c == '\n':
+			esc = "\\n"
+		case c == '\r':
+			esc = "\\r"
+		case c == '\t':
+			esc = "\\t"
+		case c < ' ' || c == '<' || c == '>' || c == '&' || c == '=':
+			esc = fmt.Sprintf("\\x%02x", c)
+		case c == 0xe2 && i+2 < len(b) && b[i+1] == 0x80 && (b[i+2] == 0xa8 || b[i+2] == 0xa9):
+			// U+2028 and U+2029 end lines in JavaScript
+			w.Write(b[last:i])
+			fmt.Fprintf(w, "\\u20%02x", b[i+2]-0x80)
+			i += 2
+			last = i + 1
+			continue
+		default:
+			continue
+		}
+		w.Write(b[last:i])
+		io.WriteString(w, esc)
+		last = i + 1
+	}
+	w.Write(b[last:])
+}
+
+// jsRegexpEscape escapes b for a JavaScript regular expression literal,
+// where it matches itself.  Nothing is written as (?:), for // would start
+// a comment.
+func jsRegexpEscape(w io.Writer, b []byte) {
+	if len(b) == 0 {
+		io.WriteString(w, "(?:)")
+		return
+	}
+	last := 0
+	for i, c := range b {
+		if strings.IndexRune(`$()*+.?[]^{|}-`, int(c)) < 0 {
+			continue
+		}
+		jsStrEscape(w, b[last:i])
+		w.Write([]byte{'\\', c})
+		last = i + 1
+	}
+	jsStrEscape(w, b[last:])
+}
+
+// cssStrEscape escapes b for a CSS string.
+func cssStrEscape(w io.Writer, b []byte) {
+	last := 0
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == ' ' || c == '.' || c == ',' || c == '-' || c == '_' || c >= 0x80 {
+			continue
+		}
+		w.Write(b[last:i])
+		fmt.Fprintf(w, "\\%x ", c)
+		last = i + 1
+	}
+	w.Write(b[last:])
+}
+
+// cssValueFilter writes b if it is a harmless CSS value, like a keyword, a
+// length or a color, and ZfastwebZ otherwise.
+func cssValueFilter(w io.Writer, b []byte) {
+	for _, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == ' ' || c == '.' || c == ',' || c == '-' || c == '_' || c == '#' || c == '%' {
+			continue
+		}
+		io.WriteString(w, "ZfastwebZ")
+		return
+	}
+	if bytes.Index(bytes.ToLower(b), []byte("expression")) >= 0 {
+		io.WriteString(w, "ZfastwebZ")
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,153 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bytes"
+	"testing"
+)
+
+type escapeData struct {
+	X     string
+	Items []string
+}
+
+type escapeTest struct {
+	what string
+	src  string
+	x    string
+	want string
+}
+
+var escapeTests = []escapeTest{
+	{
+		"apostrophe in a line comment",
+		"<script>// don't\nvar x = <%X%>;</script>",
+		"alert(1)",
+		"<script>// don't\nvar x = \"alert(1)\";</script>",
+	},
+	{
+		"apostrophe in a block comment",
+		"<script>/* don't */ var x = <%X%>;</script>",
+		"alert(1)",
+		"<script>/* don't */ var x = \"alert(1)\";</script>",
+	},
+	{
+		"apostrophe in a regular expression",
+		"<script>var re = /'/; var x = <%X%>;</script>",
+		"alert(1)",
+		"<script>var re = /'/; var x = \"alert(1)\";</script>",
+	},
+	{
+		"slash and apostrophe in a character class",
+		"<script>var re = /[/']/g; var x = <%X%>;</script>",
+		"alert(1)",
+		"<script>var re = /[/']/g; var x = \"alert(1)\";</script>",
+	},
+	{
+		"regular expression after a keyword",
+		"<script>return /'/.test(s) ? <%X%> : 0</script>",
+		"alert(1)",
+		"<script>return /'/.test(s) ? \"alert(1)\" : 0</script>",
+	},
+	{
+		"division",
+		"<script>var y = a / 2, s = '<%X%>';</script>",
+		"'<b>",
+		"<script>var y = a / 2, s = '\\'\\x3cb\\x3e';</script>",
+	},
+	{
+		"division after a parenthesis",
+		"<script>var y = (a) / 2 / '<%X%>';</script>",
+		"'",
+		"<script>var y = (a) / 2 / '\\'';</script>",
+	},
+	{
+		"variable in a regular expression",
+		"<script>var re = /^<%X%>$/;</script>",
+		"a.b/c",
+		"<script>var re = /^a\\.b\\/c$/;</script>",
+	},
+	{
+		"empty regular expression",
+		"<script>var re = /<%X%>/;</script>",
+		"",
+		"<script>var re = /(?:)/;</script>",
+	},
+	{
+		"variable in a line comment",
+		"<script>// <%X%>\nf();</script>",
+		"\nalert(1)",
+		"<script>// \\nalert(1)\nf();</script>",
+	},
+	{
+		"variable in a block comment",
+		"<script>/* <%X%> */</script>",
+		"*/alert(1)",
+		"<script>/* *\\/alert(1) */</script>",
+	},
+	{
+		"apostrophe in a style sheet comment",
+		"<style>/* don't */ p { color: <%X%> }</style>",
+		"red",
+		"<style>/* don't */ p { color: red }</style>",
+	},
+	{
+		"apostrophe in an event handler comment",
+		"<a onclick=\"/* don't */ f(<%X%>)\">",
+		"alert(1)",
+		"<a onclick=\"/* don't */ f(&#34;alert(1)&#34;)\">",
+	},
+}
+
+func TestEscapeScripts(t *testing.T) {
+	for _, test := range escapeTests {
+		tmpl := New(nil)
+		tmpl.SetEscapeMode(EscapeHTML)
+		if e := tmpl.Parse(test.src); e != nil {
+			t.Errorf("%s: %s", test.what, e)
+			continue
+		}
+		var b bytes.Buffer
+		if e := tmpl.Execute(&b, &escapeData{X: test.x}); e != nil {
+			t.Errorf("%s: %s", test.what, e)
+			continue
+		}
+		if b.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.what, b.String(), test.want)
+		}
+	}
+}
+
+var branchTests = []struct {
+	src string
+	ok  bool
+}{
+	{"<%.if X%><b title=\"a\"><%.else%><i><%.end%><%X%>", true},
+	{"<a href=\"<%.section X%>/a/<%X%><%.or%>/b<%.end%>\">", true},
+	{"<%.repeated section Items%><li><%@%></li><%.alternates with%>, <%.end%>", true},
+	{"<script>x = <%.if X%>1<%.else%><%X%><%.end%> / 2</script>", true},
+	{"<script>x = <%.if X%>1<%.else%>typeof<%.end%> / 2</script>", false},
+	{"<%.if X%><script><%.else%><p><%.end%><%X%>", false},
+	{"<%.if X%><a title=\"<%.end%><%X%>", false},
+	{"<%.section X%><script>'<%.or%><script><%.end%>", false},
+	{"<script><%.section X%>'<%.end%>;</script>", false},
+	{"<%.repeated section Items%><style><%.end%>", false},
+	{"<%.repeated section Items%><%@%><%.alternates with%><a <%.end%>", false},
+}
+
+func TestEscapeBranches(t *testing.T) {
+	for _, test := range branchTests {
+		tmpl := New(nil)
+		tmpl.SetEscapeMode(EscapeHTML)
+		e := tmpl.Parse(test.src)
+		if test.ok && e != nil {
+			t.Errorf("%q: %s", test.src, e)
+		}
+		if !test.ok && e == nil {
+			t.Errorf("%q: branches in different contexts accepted", test.src)
+		}
+	}
+}
@@ -8,8 +8,10 @@ package fastweb
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -17,14 +19,24 @@ import (
 // the data item descends into the fields associated with sections, etc.
 // Parent is used to walk upwards to find variables higher in the tree.
 type state struct {
-	parent *state          // parent in hierarchy
-	data   reflect.Value   // the driver data for this section etc.
-	wr     io.Writer       // where to send output
-	buf    [2]bytes.Buffer // alternating buffers used when chaining formatters
+	parent *state               // parent in hierarchy
+	data   reflect.Value        // the driver data for this section etc.
+	loop   *loopInfo            // position in the .repeated section, if data is an item of one
+	blocks map[string]*blockRef // content of the blocks, with overrides
+	wr     io.Writer            // where to send output
+	buf    [2]bytes.Buffer      // alternating buffers used when chaining formatters
+}
+
+// Position of an item in a .repeated section, available through the
+// names @index, @key, @first, @last, @odd, @even and @length.
+type loopInfo struct {
+	index  int
+	length int
+	key    reflect.Value
 }
 
 func (parent *state) clone(data reflect.Value) *state {
-	return &state{parent: parent, data: data, wr: parent.wr}
+	return &state{parent: parent, data: data, blocks: parent.blocks, wr: parent.wr}
 }
 
 // Evaluate interfaces and pointers looking for a value that can look up the name, via a
@@ -114,7 +126,7 @@ loop:
 // a struct while the return value is not indirected - that is,
 // it represents the actual named field. Leading stars indicate
 // levels of indirection to be applied to the value.
-func (t *Template) findVar(st *state, s string) reflect.Value {
+func (t *Template) findVar(st *state, line int, s string) reflect.Value {
 	data := st.data
 	flattenedName := strings.TrimLeft(s, "*")
 	numStars := len(s) - len(flattenedName)
@@ -122,6 +134,9 @@ func (t *Template) findVar(st *state, s string) reflect.Value {
 	if s == "@" {
 		return indirectPtr(data, numStars)
 	}
+	if len(s) > 1 && s[0] == '@' {
+		return t.loopVar(st, line, s[1:])
+	}
 	for _, elem := range strings.Split(s, ".") {
 		// Look up field; data must be a struct or map.
 		data = t.lookup(st, data, elem)
@@ -132,6 +147,39 @@ func (t *Template) findVar(st *state, s string) reflect.Value {
 	return indirectPtr(data, numStars)
 }
 
+// Return the loop variable name of the innermost .repeated item st is
+// at, through the sections nested in it, or an invalid value if st is not
+// at one.
+func (t *Template) loopVar(st *state, line int, name string) reflect.Value {
+	for st.loop == nil && st.parent != nil {
+		st = st.parent
+	}
+	l := st.loop
+	if l == nil {
+		return reflect.Value{}
+	}
+	var v interface{}
+	switch name {
+	case "index":
+		v = l.index
+	case "key":
+		return l.key
+	case "first":
+		v = l.index == 0
+	case "last":
+		v = l.index == l.length-1
+	case "odd":
+		v = l.index%2 == 1
+	case "even":
+		v = l.index%2 == 0
+	case "length":
+		v = l.length
+	default:
+		t.execError(st, line, "unknown loop variable: @%s", name)
+	}
+	return reflect.ValueOf(v)
+}
+
 // Is there no data to look at?
 func empty(v reflect.Value) bool {
 	v = indirect(v)
@@ -156,13 +204,13 @@ func empty(v reflect.Value) bool {
 }
 
 // Look up a variable or method, up through the parent if necessary.
-func (t *Template) varValue(name string, st *state) reflect.Value {
-	field := t.findVar(st, name)
+func (t *Template) varValue(name string, line int, st *state) reflect.Value {
+	field := t.findVar(st, line, name)
 	if !field.IsValid() {
 		if st.parent == nil {
-			t.execError(st, t.linenum, "name not found: %s in type %s", name, st.data.Type())
+			t.execError(st, line, "name not found: %s in type %s", name, st.data.Type())
 		}
-		return t.varValue(name, st.parent)
+		return t.varValue(name, line, st.parent)
 	}
 	return field
 }
@@ -181,9 +229,14 @@ func (t *Template) writeVariable(v *variableElement, st *state) {
 	// Resolve field names
 	val := make([]interface{}, len(v.args))
 	for i, arg := range v.args {
-		if name, ok := arg.(fieldName); ok {
-			val[i] = t.varValue(string(name), st).Interface()
-		} else {
+		switch arg := arg.(type) {
+		case fieldName:
+			val[i] = t.varValue(string(arg), v.linenum, st).Interface()
+		case *exprArg:
+			if x := t.evalExpr(st, v.linenum, arg.x); x.IsValid() {
+				val[i] = x.Interface()
+			}
+		default:
 			val[i] = arg
 		}
 	}
@@ -194,7 +247,64 @@ func (t *Template) writeVariable(v *variableElement, st *state) {
 		val = val[0:1]
 		val[0] = b.Bytes()
 	}
-	t.format(st.wr, v.fmts[len(v.fmts)-1], val, v, st)
+	last := v.fmts[len(v.fmts)-1]
+	name := formatterName(last)
+	ctx := v.ctx
+	if ctx.kind == ctxNone || t.hasRaw(v.fmts) {
+		t.format(st.wr, last, val, v, st)
+		return
+	}
+	if kind, ok := escapes[name]; ok && kind == ctx.kind && t.isBuiltin(name) {
+		switch {
+		case ctx.attr == attrNone || kind == ctxHTML && ctx.attr != attrUnquoted || name == "attr":
+			t.format(st.wr, last, val, v, st)
+			return
+		case kind != ctxHTML:
+			// escaped for the value, but not for the attribute holding it
+			b := &st.buf[(len(v.fmts)-1)&1]
+			b.Reset()
+			t.format(b, last, val, v, st)
+			escContext{ctxHTML, ctx.attr}.escape(st.wr, b.Bytes())
+			return
+		}
+	}
+	b := &st.buf[(len(v.fmts)-1)&1]
+	b.Reset()
+	if len(val) == 1 {
+		if s, ok := val[0].(SafeHTML); ok && ctx.kind == ctxHTML && ctx.attr == attrNone {
+			io.WriteString(st.wr, string(s))
+			return
+		}
+		if ctx.kind == ctxJS && len(v.fmts) == 1 && last == "" {
+			// a value in a script is written as a JavaScript value
+			if ctx.attr == attrNone {
+				jsValue(st.wr, val[0])
+			} else {
+				jsValue(b, val[0])
+				escContext{ctxHTML, ctx.attr}.escape(st.wr, b.Bytes())
+			}
+			return
+		}
+	}
+	t.format(b, last, val, v, st)
+	ctx.escape(st.wr, b.Bytes())
+}
+
+// isBuiltin reports whether the formatter name is the builtin one of that
+// name, whose output escapes tells about, rather than one of the
+// formatter map.
+func (t *Template) isBuiltin(name string) bool {
+	return t.fmap == nil || t.fmap[name] == nil
+}
+
+// hasRaw reports whether the builtin raw formatter is among fmts.
+func (t *Template) hasRaw(fmts []string) bool {
+	for _, f := range fmts {
+		if name := formatterName(f); name == "raw" && t.isBuiltin(name) {
+			return true
+		}
+	}
+	return false
 }
 
 // Execute element i.  Return next index to execute.
@@ -215,6 +325,15 @@ func (t *Template) executeElement(i int, st *state) int {
 	case *repeatedElement:
 		t.executeRepeated(elem, st)
 		return elem.end
+	case *ifElement:
+		t.executeIf(elem, st)
+		return elem.end
+	case *blockElement:
+		t.executeBlock(elem, st)
+		return elem.end
+	case *includeElement:
+		t.executeInclude(elem, st)
+		return i + 1
 	}
 	e := t.elems[i]
 	t.execError(st, 0, "internal error: bad directive in execute: %v %T\n", reflect.ValueOf(e).Interface(), e)
@@ -231,7 +350,7 @@ func (t *Template) execute(start, end int, st *state) {
 // Execute a .section
 func (t *Template) executeSection(s *sectionElement, st *state) {
 	// Find driver data for this section.  It must be in the current struct.
-	field := t.varValue(s.field, st)
+	field := t.varValue(s.field, s.linenum, st)
 	if !field.IsValid() {
 		t.execError(st, s.linenum, ".section: cannot find field %s in %s", s.field, st.data.Type())
 	}
@@ -254,6 +373,48 @@ func (t *Template) executeSection(s *sectionElement, st *state) {
 	}
 }
 
+// Execute a .if, running the first block whose condition holds
+func (t *Template) executeIf(f *ifElement, st *state) {
+	for i, cond := range f.conds {
+		if cond != nil && empty(t.evalExpr(st, f.linenum, cond)) {
+			continue
+		}
+		end := f.end
+		if i+1 < len(f.starts) {
+			end = f.starts[i+1]
+		}
+		for j := f.starts[i]; j < end; {
+			j = t.executeElement(j, st)
+		}
+		return
+	}
+}
+
+// Execute a .block, or the content a template extending this one gives it
+func (t *Template) executeBlock(b *blockElement, st *state) {
+	if ref := st.blocks[b.name]; ref != nil {
+		ref.t.execute(ref.start, ref.end, st)
+		return
+	}
+	t.execute(b.start, b.end, st)
+}
+
+// Execute an .include, with the data it is given.  Names not found in the
+// data are looked up in the including template.
+func (t *Template) executeInclude(inc *includeElement, st *state) {
+	if inc.tmpl == nil {
+		t.execError(st, inc.linenum, ".include: view %s is not linked", inc.name)
+	}
+	data := st.data
+	if inc.arg != nil {
+		data = t.evalExpr(st, inc.linenum, inc.arg)
+	}
+	it := inc.tmpl
+	newst := st.clone(data)
+	newst.blocks = it.blocks
+	it.execute(0, len(it.elems), newst)
+}
+
 // Return the result of calling the Iter method on v, or nil.
 func iter(v reflect.Value) reflect.Value {
 	for j := 0; j < v.Type().NumMethod(); j++ {
@@ -274,10 +435,59 @@ func iter(v reflect.Value) reflect.Value {
 	return reflect.Value{}
 }
 
+// keySorter orders the keys of a map: numbers by value, strings
+// lexically, anything else by its printed form.
+type keySorter []reflect.Value
+
+func (k keySorter) Len() int      { return len(k) }
+func (k keySorter) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+
+func (k keySorter) Less(i, j int) bool {
+	a, b := indirect(k[i]), indirect(k[j])
+	ca, cb := cmpClass(a), cmpClass(b)
+	switch {
+	case ca == cmpInt && cb == cmpInt:
+		return a.Int() < b.Int()
+	case ca == cmpUint && cb == cmpUint:
+		return a.Uint() < b.Uint()
+	case ca >= cmpInt && ca <= cmpFloat && cb >= cmpInt && cb <= cmpFloat:
+		return toFloat(a) < toFloat(b)
+	case ca == cmpString && cb == cmpString:
+		return a.String() < b.String()
+	}
+	return fmt.Sprint(k[i].Interface()) < fmt.Sprint(k[j].Interface())
+}
+
+// mapKeys returns the keys of the map m in the order they are repeated
+// in: the order returned by a Keys method of the map type, which takes no
+// arguments and returns a slice of keys, or else sorted.
+func mapKeys(m reflect.Value) []reflect.Value {
+	typ := m.Type()
+	for j := 0; j < typ.NumMethod(); j++ {
+		mth := typ.Method(j)
+		mt := mth.Type
+		if mth.Name != "Keys" || mt.NumIn() != 1 || mt.NumOut() != 1 {
+			continue
+		}
+		if out := mt.Out(0); out.Kind() != reflect.Slice || out.Elem() != typ.Key() {
+			continue
+		}
+		ks := m.Method(j).Call(nil)[0]
+		keys := make([]reflect.Value, ks.Len())
+		for i := range keys {
+			keys[i] = ks.Index(i)
+		}
+		return keys
+	}
+	keys := m.MapKeys()
+	sort.Sort(keySorter(keys))
+	return keys
+}
+
 // Execute a .repeated section
 func (t *Template) executeRepeated(r *repeatedElement, st *state) {
 	// Find driver data for this section.  It must be in the current struct.
-	field := t.varValue(r.field, st)
+	field := t.varValue(r.field, r.linenum, st)
 	if !field.IsValid() {
 		t.execError(st, r.linenum, ".repeated: cannot find field %s in %s", r.field, st.data.Type())
 	}
@@ -293,7 +503,8 @@ func (t *Template) executeRepeated(r *repeatedElement, st *state) {
 	first := true
 
 	// Code common to all the loops.
-	loopBody := func(newst *state) {
+	loopBody := func(newst *state, loop *loopInfo) {
+		newst.loop = loop
 		// .alternates between elements
 		if !first && r.altstart >= 0 {
 			for i := r.altstart; i < r.altend; {
@@ -307,20 +518,27 @@ func (t *Template) executeRepeated(r *repeatedElement, st *state) {
 	}
 
 	if array := field; array.Kind() == reflect.Array || array.Kind() == reflect.Slice {
-		for j := 0; j < array.Len(); j++ {
-			loopBody(st.clone(array.Index(j)))
+		n := array.Len()
+		for j := 0; j < n; j++ {
+			loopBody(st.clone(array.Index(j)), &loopInfo{j, n, reflect.ValueOf(j)})
 		}
 	} else if m := field; m.Kind() == reflect.Map {
-		for _, key := range m.MapKeys() {
-			loopBody(st.clone(m.MapIndex(key)))
+		keys := mapKeys(m)
+		for j, key := range keys {
+			loopBody(st.clone(m.MapIndex(key)), &loopInfo{j, len(keys), key})
 		}
 	} else if ch := iter(field); ch.IsValid() {
+		// gather the items first, for @last and @length
+		var items []reflect.Value
 		for {
 			e, ok := ch.Recv()
 			if !ok {
 				break
 			}
-			loopBody(st.clone(e))
+			items = append(items, e)
+		}
+		for j, e := range items {
+			loopBody(st.clone(e), &loopInfo{j, len(items), reflect.ValueOf(j)})
 		}
 	} else {
 		t.execError(st, r.linenum, ".repeated: cannot repeat %s (type %s)",
@@ -0,0 +1,502 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Expressions, as found in .if, .elif, .include and variables calling
+// functions:
+//
+//	expr    = and { ("or" | "||") and }
+//	and     = not { ("and" | "&&") not }
+//	not     = ("not" | "!") not | compare
+//	compare = operand [ ("==" | "!=" | "<" | "<=" | ">" | ">=") operand ]
+//	operand = literal | field | call | "(" expr ")"
+//	call    = name "(" [ expr { "," expr } ] ")"
+//
+// Literals are quoted strings, characters, numbers, true, false and nil.
+// Fields are looked up like variables.  Calls run the function of that name
+// in the FuncMap of the template.
+
+// FuncMap maps names to the functions templates can call.  A function
+// returns one value, or a value and an os.Error, which stops the execution
+// of the template if not nil.
+type FuncMap map[string]interface{}
+
+// checkFunc returns an error if fn can't be called from a template.
+func checkFunc(name string, fn interface{}) os.Error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return os.NewError("template function " + name + " is not a function")
+	}
+	switch typ := v.Type(); typ.NumOut() {
+	case 1:
+	case 2:
+		if out := typ.Out(1); out.Kind() != reflect.Interface || out.PkgPath() != "os" || out.Name() != "Error" {
+			return os.NewError("second result of template function " + name + " is not an os.Error")
+		}
+	default:
+		return os.NewError("template function " + name + " must return one or two values")
+	}
+	return nil
+}
+
+// A literal operand.
+type exprLiteral struct {
+	val reflect.Value
+}
+
+// A field operand, looked up through findVar.
+type exprField struct {
+	name string
+}
+
+type exprNot struct {
+	x interface{}
+}
+
+// An and, or or comparison.
+type exprBinary struct {
+	op   string
+	x, y interface{}
+}
+
+// A function call.
+type exprCall struct {
+	name string
+	fn   reflect.Value
+	args []interface{}
+}
+
+// An expression among the arguments of a variable.
+type exprArg struct {
+	x interface{}
+}
+
+// exprParser parses the tokens of one expression.
+type exprParser struct {
+	t    *Template
+	toks []string
+	pos  int
+}
+
+// isOpChar reports whether c may be part of an operator.
+func isOpChar(c byte) bool {
+	return strings.IndexRune("=!<>&|(),", int(c)) >= 0
+}
+
+// exprTokens splits s into the tokens of an expression.
+func (t *Template) exprTokens(s string) []string {
+	var toks []string
+	b := []byte(s)
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case isQuote(c):
+			end := endQuote(b, i)
+			if end < 0 {
+				t.parseError("unmatched quote in expression: %s", s)
+			}
+			toks = append(toks, s[i:end+1])
+			i = end + 1
+			continue
+		case isOpChar(c):
+			n := 1
+			if i+1 < len(b) {
+				switch s[i : i+2] {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					n = 2
+				}
+			}
+			toks = append(toks, s[i:i+n])
+			i += n
+			continue
+		}
+		start := i
+		for i < len(b) && !isSpace(b[i]) && !isOpChar(b[i]) && !isQuote(b[i]) {
+			i++
+		}
+		toks = append(toks, s[start:i])
+	}
+	return toks
+}
+
+// parseExpr parses the expression s.
+func (t *Template) parseExpr(s string) interface{} {
+	p := &exprParser{t: t, toks: t.exprTokens(s)}
+	if len(p.toks) == 0 {
+		t.parseError("missing expression")
+	}
+	x := p.or()
+	if p.pos < len(p.toks) {
+		t.parseError("unexpected %q in expression: %s", p.toks[p.pos], s)
+	}
+	return x
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	tok := p.peek()
+	if tok == "" {
+		p.t.parseError("unexpected end of expression")
+	}
+	p.pos++
+	return tok
+}
+
+func (p *exprParser) or() interface{} {
+	x := p.and()
+	for tok := p.peek(); tok == "or" || tok == "||"; tok = p.peek() {
+		p.pos++
+		x = &exprBinary{"or", x, p.and()}
+	}
+	return x
+}
+
+func (p *exprParser) and() interface{} {
+	x := p.not()
+	for tok := p.peek(); tok == "and" || tok == "&&"; tok = p.peek() {
+		p.pos++
+		x = &exprBinary{"and", x, p.not()}
+	}
+	return x
+}
+
+func (p *exprParser) not() interface{} {
+	if tok := p.peek(); tok == "not" || tok == "!" {
+		p.pos++
+		return &exprNot{p.not()}
+	}
+	return p.compare()
+}
+
+func (p *exprParser) compare() interface{} {
+	x := p.operand()
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		return &exprBinary{op, x, p.operand()}
+	}
+	return x
+}
+
+func (p *exprParser) operand() interface{} {
+	tok := p.next()
+	switch tok {
+	case "(":
+		x := p.or()
+		if p.next() != ")" {
+			p.t.parseError("missing ) in expression")
+		}
+		return x
+	case "true":
+		return &exprLiteral{reflect.ValueOf(true)}
+	case "false":
+		return &exprLiteral{reflect.ValueOf(false)}
+	case "nil":
+		return &exprLiteral{}
+	}
+	switch c := tok[0]; {
+	case isQuote(c):
+		v, e := strconv.Unquote(tok)
+		if e != nil {
+			p.t.parseError("invalid literal: %q: %s", tok, e)
+		}
+		if c == '\'' {
+			return &exprLiteral{reflect.ValueOf([]int(v)[0])}
+		}
+		return &exprLiteral{reflect.ValueOf(v)}
+	case c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' && len(tok) > 1 && tok[1] >= '0' && tok[1] <= '9':
+		if v, e := strconv.Btoi64(tok, 0); e == nil {
+			return &exprLiteral{reflect.ValueOf(v)}
+		}
+		v, e := strconv.Atof64(tok)
+		if e != nil {
+			p.t.parseError("invalid literal: %q: %s", tok, e)
+		}
+		return &exprLiteral{reflect.ValueOf(v)}
+	case isOpChar(c):
+		p.t.parseError("unexpected %q in expression", tok)
+	}
+	if p.peek() == "(" {
+		return p.call(tok)
+	}
+	return &exprField{tok}
+}
+
+func (p *exprParser) call(name string) interface{} {
+	fn, ok := p.t.funcs[name]
+	if !ok {
+		p.t.parseError("unknown function: %s", name)
+	}
+	if e := checkFunc(name, fn); e != nil {
+		p.t.parseError("%s", e)
+	}
+	x := &exprCall{name: name, fn: reflect.ValueOf(fn)}
+	p.pos++ // (
+	if p.peek() == ")" {
+		p.pos++
+		return x
+	}
+	for {
+		x.args = append(x.args, p.or())
+		switch p.next() {
+		case ",":
+			continue
+		case ")":
+			return x
+		}
+		p.t.parseError("missing ) in call of %s", name)
+	}
+	return x
+}
+
+// evalExpr evaluates the expression x in st.
+func (t *Template) evalExpr(st *state, line int, x interface{}) reflect.Value {
+	switch x := x.(type) {
+	case *exprLiteral:
+		return x.val
+	case *exprField:
+		return t.varValue(x.name, line, st)
+	case *exprNot:
+		return reflect.ValueOf(empty(t.evalExpr(st, line, x.x)))
+	case *exprBinary:
+		switch x.op {
+		case "and":
+			return reflect.ValueOf(!empty(t.evalExpr(st, line, x.x)) && !empty(t.evalExpr(st, line, x.y)))
+		case "or":
+			return reflect.ValueOf(!empty(t.evalExpr(st, line, x.x)) || !empty(t.evalExpr(st, line, x.y)))
+		}
+		return reflect.ValueOf(t.compare(st, line, x.op, t.evalExpr(st, line, x.x), t.evalExpr(st, line, x.y)))
+	case *exprCall:
+		return t.call(st, line, x)
+	}
+	t.execError(st, line, "internal error: bad expression %T", x)
+	return reflect.Value{}
+}
+
+// call evaluates the arguments of x and calls its function with them.
+func (t *Template) call(st *state, line int, x *exprCall) reflect.Value {
+	typ := x.fn.Type()
+	variadic := typ.IsVariadic()
+	n := typ.NumIn()
+	if variadic && len(x.args) < n-1 || !variadic && len(x.args) != n {
+		t.execError(st, line, "wrong number of arguments in call of %s: %d", x.name, len(x.args))
+	}
+	args := make([]reflect.Value, len(x.args))
+	for i, arg := range x.args {
+		var ptype reflect.Type
+		if variadic && i >= n-1 {
+			ptype = typ.In(n - 1).Elem()
+		} else {
+			ptype = typ.In(i)
+		}
+		v, ok := convertArg(t.evalExpr(st, line, arg), ptype)
+		if !ok {
+			t.execError(st, line, "cannot use argument %d (type %s) as %s in call of %s", i+1, typeName(v), ptype, x.name)
+		}
+		args[i] = v
+	}
+	out := x.fn.Call(args)
+	if len(out) == 2 && !out[1].IsNil() {
+		t.execError(st, line, "%s: %s", x.name, out[1].Interface().(os.Error))
+	}
+	return out[0]
+}
+
+func typeName(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	return v.Type().String()
+}
+
+// convertArg returns v as a value of type typ, converting numbers between
+// types.
+func convertArg(v reflect.Value, typ reflect.Type) (reflect.Value, bool) {
+	if !v.IsValid() {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+			return reflect.Zero(typ), true
+		}
+		return v, false
+	}
+	if v.Type() == typ {
+		return v, true
+	}
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+		if v.Type() == typ {
+			return v, true
+		}
+	}
+	r := reflect.New(typ).Elem()
+	switch c := cmpClass(v); typ.Kind() {
+	case reflect.Interface:
+		if typ.NumMethod() == 0 {
+			r.Set(v)
+			return r, true
+		}
+		if v.Type().Implements(typ) {
+			r.Set(v)
+			return r, true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch c {
+		case cmpInt:
+			r.SetInt(v.Int())
+			return r, true
+		case cmpUint:
+			r.SetInt(int64(v.Uint()))
+			return r, true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch c {
+		case cmpInt:
+			r.SetUint(uint64(v.Int()))
+			return r, true
+		case cmpUint:
+			r.SetUint(v.Uint())
+			return r, true
+		}
+	case reflect.Float32, reflect.Float64:
+		if c == cmpInt || c == cmpUint || c == cmpFloat {
+			r.SetFloat(toFloat(v))
+			return r, true
+		}
+	case reflect.String:
+		if c == cmpString {
+			r.SetString(v.String())
+			return r, true
+		}
+	}
+	return v, false
+}
+
+func isNil(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Classes of values for comparisons.
+const (
+	cmpOther = iota
+	cmpInt
+	cmpUint
+	cmpFloat
+	cmpString
+	cmpBool
+)
+
+func cmpClass(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmpInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cmpUint
+	case reflect.Float32, reflect.Float64:
+		return cmpFloat
+	case reflect.String:
+		return cmpString
+	case reflect.Bool:
+		return cmpBool
+	}
+	return cmpOther
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch cmpClass(v) {
+	case cmpInt:
+		return float64(v.Int())
+	case cmpUint:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// compare applies the comparison op to a and b.  Numbers of any type
+// compare by value, strings lexically; other values can only be tested
+// for equality.
+func (t *Template) compare(st *state, line int, op string, a, b reflect.Value) bool {
+	if isNil(a) || isNil(b) {
+		if op != "==" && op != "!=" {
+			t.execError(st, line, "cannot compare nil with %s", op)
+		}
+		return (isNil(a) && isNil(b)) == (op == "==")
+	}
+	if a, b = indirect(a), indirect(b); !a.IsValid() || !b.IsValid() {
+		return (a.IsValid() == b.IsValid()) == (op == "==")
+	}
+	ca, cb := cmpClass(a), cmpClass(b)
+
+	var c int // -1, 0 or 1 for ordered values
+	switch {
+	case ca == cmpInt && cb == cmpInt:
+		x, y := a.Int(), b.Int()
+		c = sign(x < y, x > y)
+	case ca == cmpUint && cb == cmpUint:
+		x, y := a.Uint(), b.Uint()
+		c = sign(x < y, x > y)
+	case ca >= cmpInt && ca <= cmpFloat && cb >= cmpInt && cb <= cmpFloat:
+		x, y := toFloat(a), toFloat(b)
+		c = sign(x < y, x > y)
+	case ca == cmpString && cb == cmpString:
+		x, y := a.String(), b.String()
+		c = sign(x < y, x > y)
+	default:
+		eq := a.Type() == b.Type() && reflect.DeepEqual(a.Interface(), b.Interface())
+		switch op {
+		case "==":
+			return eq
+		case "!=":
+			return !eq
+		}
+		t.execError(st, line, "cannot compare %s and %s with %s", a.Type(), b.Type(), op)
+	}
+
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func sign(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
@@ -5,21 +5,20 @@
 package fastweb
 
 import (
-	"bufio"
-	"bytes"
 	"container/vector"
 	"go-fastcgi.googlecode.com/svn/trunk/src/fastcgi"
 	"fmt"
+	"http"
 	"url"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"rand"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -29,9 +28,19 @@ const (
 	StrParam = 2
 )
 
+// Default limits on request bodies, see Application.MaxBodySize.
+const (
+	defaultMaxBodySize  = 32 << 20
+	defaultMaxFileSize  = 32 << 20
+	defaultMaxFieldSize = 1 << 20
+	defaultMaxParts     = 1000
+)
+
 type ControllerInterface interface {
 	Init()
 	DefaultAction() string
+	ParseBody(action string) bool
+	BodyLimit(action string) int64
 	SetEnv(env *env)
 	PreFilter()
 	Render()
@@ -68,6 +77,57 @@ type controllerInfo struct {
 type Application struct {
 	controllerMap     map[string]*controllerInfo
 	defaultController string
+	staticDirs        []*staticDir
+
+	// ShutdownTimeout is how long, in nanoseconds, a shutdown triggered
+	// by SIGTERM or SIGINT waits for the requests in flight, once the
+	// signals package handles them.  A second signal exits without
+	// waiting.
+	ShutdownTimeout int64
+
+	// SocketMode is the permission bits of the Unix domain sockets created
+	// by Run and RunHTTP.
+	SocketMode uint32
+
+	// Limits on request bodies, in bytes except for MaxParts.  Exceeding
+	// one aborts parsing and the request is answered with 413 through
+	// ErrorHandler.  NewApplication sets the defaults below; set a limit to
+	// zero to lift it.
+	MaxBodySize  int64 // the whole request body, 32 MB, see Controller.BodyLimit
+	MaxFileSize  int64 // each uploaded file, 32 MB
+	MaxFieldSize int64 // each non-file form field, 1 MB
+	MaxParts     int   // number of parts of a multipart body, 1000
+
+	// SniffUploads makes the framework detect the type of uploaded files
+	// from their first bytes, see Upload.SniffedType.
+	SniffUploads bool
+
+	// TrustedProxies lists the IP addresses of the reverse proxies whose
+	// X-Forwarded-For and X-Forwarded-Proto headers are believed.
+	TrustedProxies []string
+
+	// TempDir is where uploaded files are stored while a request is
+	// handled.  It defaults to $TMPDIR, or /tmp.
+	TempDir string
+
+	// VerifyViews makes RegisterController check the views of the
+	// controller against its type and log the errors, see CheckViews.
+	VerifyViews bool
+
+	compress  *compressConfig
+	funcs     FuncMap
+	fs        FileSystem
+	viewsRoot string
+	viewMode  int
+	tmplLock  sync.RWMutex
+	tmplCache map[string]*tmplInfo
+	lock      sync.Mutex
+	listeners []net.Listener
+	active    int
+	closing   bool
+	closed    bool
+	drained   chan bool
+	done      chan bool
 }
 
 type env struct {
@@ -77,18 +137,18 @@ type env struct {
 	action      string
 	laction     string
 	params      []string
-	request     *fastcgi.Request
+	app         *Application
+	request     *Request
+	response    *responseBuffer
 	body        string
+	bodyReader  io.Reader
+	query       map[string][]string
+	postForm    map[string][]string
 	form        map[string][]string
 	upload      map[string][](*Upload)
 	cookies     map[string]string
 }
 
-type Upload struct {
-	File     *os.File
-	Filename string
-}
-
 type cookie struct {
 	value    string
 	expire   *time.Time
@@ -108,15 +168,22 @@ type Controller struct {
 	PageTitle   string
 	Layout      string
 	ContentType string
+	Status      int
 	Body        string
+	BodyReader  io.Reader
+	Query       map[string][]string
+	PostForm    map[string][]string
 	Form        map[string][]string
 	Upload      map[string][]*Upload
 	Cookies     map[string]string
 	Session     *Session
 	setCookies  map[string]*cookie
 	ctxt        ControllerInterface
-	Request     *fastcgi.Request
-	preRenered  bool
+	Request     *Request
+	Response    ResponseWriter
+	out         *responseBuffer
+	bodyETag    bool
+	app         *Application
 }
 
 func NewError(typ string, message string) *ErrorStruct {
@@ -131,10 +198,21 @@ func (c *Controller) Init() {
 	c.PageTitle = ""
 	c.Layout = "default"
 	c.ContentType = "text/html; charset=utf-8"
+	c.Status = http.StatusOK
 }
 
 func (c *Controller) DefaultAction() string { return "Index" }
 
+// ParseBody reports whether the request body is parsed into Form and Upload
+// before action runs.  Controllers return false for actions that process
+// the body themselves, through BodyReader or MultipartReader.
+func (c *Controller) ParseBody(action string) bool { return true }
+
+// BodyLimit returns the limit in bytes on the request body of action.  A
+// negative limit, the default, stands for Application.MaxBodySize; zero
+// lifts it.  Actions reading large bodies through BodyReader raise it.
+func (c *Controller) BodyLimit(action string) int64 { return -1 }
+
 func (c *Controller) SetEnv(env *env) {
 	c.Name = env.controller
 	c.LName = env.lcontroller
@@ -143,7 +221,12 @@ func (c *Controller) SetEnv(env *env) {
 	c.Path = env.path
 	c.Params = env.params
 	c.Request = env.request
+	c.setResponse(env.response)
+	c.app = env.app
 	c.Body = env.body
+	c.BodyReader = env.bodyReader
+	c.Query = env.query
+	c.PostForm = env.postForm
 	c.Form = env.form
 	c.Upload = env.upload
 	c.Cookies = env.cookies
@@ -152,37 +235,136 @@ func (c *Controller) SetEnv(env *env) {
 func (c *Controller) PreFilter() {}
 
 type tmplInfo struct {
-	tmpl  *Template
-	mtime int64
+	tmpl *Template
+	deps map[string]int64 // mtimes of the files the template is built from
 }
 
-var tmplCache map[string]*tmplInfo = make(map[string]*tmplInfo)
+// stale reports whether one of the files ti was built from has changed in
+// fs.
+func (ti *tmplInfo) stale(fs FileSystem) bool {
+	for fname, mtime := range ti.deps {
+		dir, e := fs.Stat(fname)
+		if e != nil || dir.Mtime_ns > mtime {
+			return true
+		}
+	}
+	return false
+}
+
+// viewPath returns the file of the view name, relative to the views root.
+func (a *Application) viewPath(name string) string {
+	if !strings.HasSuffix(name, ".tpl") {
+		name += ".tpl"
+	}
+	if a == nil {
+		return "views/" + name
+	}
+	return a.viewsRoot + "/" + name
+}
 
-func loadTemplate(fname string) (*Template, os.Error) {
-	dir, e := os.Stat(fname)
+// loadTemplate returns the template in fname.  If it extends another view,
+// the template returned is resolved against it, and the views it includes
+// are linked.  Templates are cached; unless the views are preloaded or
+// watched, their files are checked for changes each time.
+func (a *Application) loadTemplate(fname string) (*Template, os.Error) {
+	if a == nil {
+		return nil, NewError("Generic", "no application to load '"+fname+"' from")
+	}
+	// renders share the cache under the read lock, even while loading
+	a.tmplLock.RLock()
+	cache := a.tmplCache
+	loaded := make(map[string]*tmplInfo)
+	ti, e := a.loadTemplateChain(fname, nil, loaded)
+	a.tmplLock.RUnlock()
+	if e != nil {
+		return nil, e
+	}
+	if len(loaded) > 0 {
+		a.tmplLock.Lock()
+		for f, ti := range loaded {
+			cache[f] = ti
+		}
+		a.tmplLock.Unlock()
+	}
+	return ti.tmpl, nil
+}
+
+// loadTemplateChain loads fname, which is extended or included by the
+// templates in chain.  The templates missing from the cache or stale
+// there are loaded and added to loaded, for the caller to store.
+func (a *Application) loadTemplateChain(fname string, chain []string, loaded map[string]*tmplInfo) (*tmplInfo, os.Error) {
+	for _, f := range chain {
+		if f == fname {
+			return nil, NewError("Generic", "'"+fname+"' includes or extends itself through "+strings.Join(chain, ", "))
+		}
+	}
+	if ti := loaded[fname]; ti != nil {
+		return ti, nil
+	}
+	if ti := a.tmplCache[fname]; ti != nil {
+		if a.viewMode != viewsChecked || !ti.stale(a.fs) {
+			return ti, nil
+		}
+	}
+	dir, e := a.fs.Stat(fname)
 	if e != nil {
 		return nil, e
 	}
 	if !dir.IsRegular() {
 		return nil, NewError("Generic", "'"+fname+"' is not a regular file")
 	}
-	ti, _ := tmplCache[fname]
-	if ti == nil || dir.Mtime_ns > ti.mtime {
-		bytes, e := ioutil.ReadFile(fname)
+	bytes, e := readFile(a.fs, fname)
+	if e != nil {
+		return nil, e
+	}
+	t := New(nil)
+	t.SetFuncs(a.funcs)
+	t.SetEscapeMode(escapeMode(fname))
+	t.file = fname
+	if e := t.Parse(string(bytes)); e != nil {
+		return nil, viewError(fname, e)
+	}
+	deps := map[string]int64{fname: dir.Mtime_ns}
+	chain = append(chain, fname)
+	for _, inc := range t.includes {
+		it, e := a.loadTemplateChain(a.viewPath(inc.name), chain, loaded)
 		if e != nil {
 			return nil, e
 		}
-		t, e := Parse(string(bytes), nil)
+		for f, mtime := range it.deps {
+			deps[f] = mtime
+		}
+		if e := t.Link(inc.name, it.tmpl); e != nil {
+			return nil, viewError(fname, e)
+		}
+	}
+	if t.parent != "" {
+		p, e := a.loadTemplateChain(a.viewPath(t.parent), chain, loaded)
 		if e != nil {
 			return nil, e
 		}
-		ti = &tmplInfo{
-			mtime: dir.Mtime_ns,
-			tmpl:  t,
+		for f, mtime := range p.deps {
+			deps[f] = mtime
+		}
+		if t, e = t.Resolve(p.tmpl); e != nil {
+			return nil, viewError(fname, e)
 		}
-		tmplCache[fname] = ti
 	}
-	return ti.tmpl, nil
+	ti := &tmplInfo{
+		tmpl: t,
+		deps: deps,
+	}
+	loaded[fname] = ti
+	return ti, nil
+}
+
+// viewError returns e, an error of the view fname, as a *ViewError if it
+// tells the line.
+func viewError(fname string, e os.Error) os.Error {
+	if te, ok := e.(*TemplateError); ok {
+		return &ViewError{fname, te.Line, te.Msg}
+	}
+	return e
 }
 
 func (c *Controller) SetContext(ctxt ControllerInterface) {
@@ -191,35 +373,62 @@ func (c *Controller) SetContext(ctxt ControllerInterface) {
 	}
 }
 
-func (c *Controller) preRender() {
-	if !c.preRenered {
-		io.WriteString(c.Request.Stdout, "Content-Type: "+c.ContentType+"\r\n")
+// setResponse makes the controller write to out, which sends the status,
+// the content type and the cookies of the controller when it sends the
+// header.
+func (c *Controller) setResponse(out *responseBuffer) {
+	out.before = func() int { return c.sendHeader() }
+	c.out = out
+	c.Response = out
+}
 
-		if c.setCookies != nil {
-			for k, ck := range c.setCookies {
-				s := "Set-Cookie: " + k + "=" + url.QueryEscape(ck.value)
-				if ck.expire != nil {
-					s += "; expire=" + ck.expire.Format(time.RFC1123)
-				}
-				if ck.path != "" {
-					s += "; path=" + ck.path
-				}
-				if ck.domain != "" {
-					s += "; path=" + ck.domain
-				}
-				if ck.secure {
-					s += "; secure"
-				}
-				if ck.httpOnly {
-					s += "; HttpOnly"
-				}
-				io.WriteString(c.Request.Stdout, s+"\r\n")
+func (c *Controller) sendHeader() int {
+	h := c.Response.Header()
+	if c.ContentType != "" {
+		h.Set("Content-Type", c.ContentType)
+	}
+
+	if c.setCookies != nil {
+		for k, ck := range c.setCookies {
+			s := k + "=" + url.QueryEscape(ck.value)
+			if ck.expire != nil {
+				s += "; expire=" + ck.expire.Format(time.RFC1123)
+			}
+			if ck.path != "" {
+				s += "; path=" + ck.path
+			}
+			if ck.domain != "" {
+				s += "; path=" + ck.domain
 			}
+			if ck.secure {
+				s += "; secure"
+			}
+			if ck.httpOnly {
+				s += "; HttpOnly"
+			}
+			h.Add("Set-Cookie", s)
 		}
+	}
 
-		io.WriteString(c.Request.Stdout, "\r\n")
-		c.preRenered = true
+	if c.Status == 0 {
+		c.Status = http.StatusOK
 	}
+	return c.Status
+}
+
+// Flush sends the header and what has been rendered so far to the client.
+// From then on the response is streamed: what is written goes out as it
+// is, without Content-Length, and the status, the headers and the cookies
+// can no longer be changed.  Actions producing large or long-running
+// responses call it before writing.
+func (c *Controller) Flush() {
+	c.out.Flush()
+}
+
+// ResetOutput discards what has been rendered so far, unless the response
+// has been flushed already.
+func (c *Controller) ResetOutput() {
+	c.out.Reset()
 }
 
 func executeTemplate(fname string, t *Template, w io.Writer, data interface{}) {
@@ -230,55 +439,58 @@ func executeTemplate(fname string, t *Template, w io.Writer, data interface{}) {
 }
 
 func (c *Controller) RenderContent() string {
-	c.preRender()
-
-	fname := "views/" + c.LName + "/" + c.LAction + ".tpl"
-	t, e := loadTemplate(fname)
+	fname := c.app.viewPath(c.LName + "/" + c.LAction)
+	t, e := c.app.loadTemplate(fname)
 	if e != nil {
 		// Dump c.ctxt contents
 	}
 
 	if t != nil {
-		executeTemplate(fname, t, c.Request.Stdout, c.ctxt)
+		executeTemplate(fname, t, c.Response, c.ctxt)
 	}
 
 	return ""
 }
 
 func (c *Controller) renderTemplate(fname string) {
-	t, e := loadTemplate(fname)
+	t, e := c.app.loadTemplate(fname)
 	if e == nil {
-		executeTemplate(fname, t, c.Request.Stdout, c.ctxt)
+		executeTemplate(fname, t, c.Response, c.ctxt)
 	} else {
 		log.Printf("failed to load template %s: %s", fname, e)
 	}
 }
 
 func (c *Controller) RenderElement(name string) string {
-	c.renderTemplate("views/elements/" + name + ".tpl")
+	c.renderTemplate(c.app.viewPath("elements/" + name))
 	return ""
 }
 
 func (c *Controller) RenderControllerElement(name string) string {
-	c.renderTemplate("views/" + c.LName + "/elements/" + name + ".tpl")
+	c.renderTemplate(c.app.viewPath(c.LName + "/elements/" + name))
 	return ""
 }
 
 func (c *Controller) Render() {
-	c.preRender()
-
 	if len(c.Layout) == 0 {
 		c.RenderContent()
 		return
 	}
 
-	fname := "views/layouts/" + c.Layout + ".tpl"
-	t, e := loadTemplate(fname)
+	// a view extending another one brings its layout along
+	fname := c.app.viewPath(c.LName + "/" + c.LAction)
+	if t, e := c.app.loadTemplate(fname); e == nil && t.parent != "" {
+		executeTemplate(fname, t, c.Response, c.ctxt)
+		return
+	}
+
+	fname = c.app.viewPath("layouts/" + c.Layout)
+	t, e := c.app.loadTemplate(fname)
 	if e != nil {
 		log.Printf("failed to load layout template %s: %s", fname, e)
 		c.RenderContent()
 	} else {
-		executeTemplate(fname, t, c.Request.Stdout, c.ctxt)
+		executeTemplate(fname, t, c.Response, c.ctxt)
 	}
 }
 
@@ -322,21 +534,35 @@ type ErrorHandler struct {
 	typ string
 }
 
-func NewErrorHandler(e Error, r *fastcgi.Request) *ErrorHandler {
+// NewErrorHandler returns the controller that reports e to the client of
+// r, with the views of a.
+func (a *Application) NewErrorHandler(e Error, w ResponseWriter, r *Request) *ErrorHandler {
 	eh := &ErrorHandler{
 		typ: e.Type(),
 	}
+	eh.app = a
 	eh.Request = r
+	eh.setResponse(newResponseBuffer(w))
 	eh.Init()
+	eh.Status = errorStatus(eh.typ)
 	eh.SetContext(eh)
 	return eh
 }
 
-func (eh *ErrorHandler) RenderContent() string {
-	eh.preRender()
+// errorStatus returns the HTTP status an error of type typ is reported with.
+func errorStatus(typ string) int {
+	switch typ {
+	case "PageNotFound":
+		return http.StatusNotFound
+	case "RequestEntityTooLarge":
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
 
-	fname := "views/errors/" + eh.typ + ".tpl"
-	t, e := loadTemplate(fname)
+func (eh *ErrorHandler) RenderContent() string {
+	fname := eh.app.viewPath("errors/" + eh.typ)
+	t, e := eh.app.loadTemplate(fname)
 	if e != nil {
 		var msg string
 		switch eh.typ {
@@ -345,10 +571,10 @@ func (eh *ErrorHandler) RenderContent() string {
 		default:
 			msg = "We're sorry, but there was an error processing your request. Please try again later."
 		}
-		fmt.Fprintf(eh.Request.Stdout, "%s", msg)
+		fmt.Fprintf(eh.Response, "%s", msg)
 	} else {
-		t.Execute(eh.Request.Stdout, eh)
-		executeTemplate(fname, t, eh.Request.Stdout, eh)
+		t.Execute(eh.Response, eh)
+		executeTemplate(fname, t, eh.Response, eh)
 	}
 
 	return ""
@@ -388,7 +614,28 @@ func deTitleCase(s string) string {
 	return s
 }
 
-func parseKeyValueString(m map[string]*vector.StringVector, s string) os.Error {
+func errTooLarge(what string, limit int64) os.Error {
+	return NewError("RequestEntityTooLarge", fmt.Sprintf("%s exceeds the limit of %d bytes", what, limit))
+}
+
+// bodyLimiter fails, rather than returning EOF, once more than limit bytes
+// are read from r.
+type bodyLimiter struct {
+	r     io.Reader
+	left  int64
+	limit int64
+}
+
+func (l *bodyLimiter) Read(p []byte) (int, os.Error) {
+	n, e := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return 0, errTooLarge("request body", l.limit)
+	}
+	return n, e
+}
+
+func parseKeyValueString(m map[string]*vector.StringVector, s string, limit int64) os.Error {
 	if s == "" {
 		return nil
 	}
@@ -409,6 +656,9 @@ func parseKeyValueString(m map[string]*vector.StringVector, s string) os.Error {
 		if e != nil {
 			return e
 		}
+		if limit > 0 && int64(len(value)) > limit {
+			return errTooLarge("form field '"+key+"'", limit)
+		}
 
 		vec, ok := m[key]
 		if !ok {
@@ -421,347 +671,89 @@ func parseKeyValueString(m map[string]*vector.StringVector, s string) os.Error {
 	return nil
 }
 
-var boundaryRE, _ = regexp.Compile("boundary=\"?([^\";,]+)\"?")
-
-type multipartReader struct {
-	rd   io.Reader
-	bd   []byte
-	buf  []byte
-	head int
-	tail int
-	eof  bool
-	done bool
-}
-
-func newMultipartReader(rd io.Reader, bd string) *multipartReader {
-	return &multipartReader{
-		rd:   rd,
-		bd:   []byte("\r\n--" + bd),
-		buf:  make([]byte, 4096),
-		head: 0,
-		tail: 0,
-	}
-}
-
-func (md *multipartReader) finished() bool { return md.done }
-
-func (md *multipartReader) read(delim []byte) ([]byte, os.Error) {
-	if md.done {
-		return nil, os.EOF
-	}
-
-	if !md.eof && md.tail < len(md.buf) {
-		n, e := md.rd.Read(md.buf[md.tail:len(md.buf)])
-		if e != nil {
-			if e != os.EOF {
-				return nil, e
-			}
-			md.eof = true
-		}
-		md.tail += n
-	}
-
-	if i := bytes.Index(md.buf[md.head:md.tail], delim); i >= 0 {
-		s := make([]byte, i)
-		copy(s, md.buf[md.head:md.head+i])
-		md.head += i + len(delim)
-		return s, os.EOF
-	}
-
-	if md.eof {
-		md.done = true
-		return md.buf[md.head:md.tail], os.EOF
-	}
-
-	bf := md.tail - md.head
-	keep := len(delim) - 1
-	if keep > bf {
-		keep = bf
-	}
-	stop := md.tail - keep
-	n := stop - md.head
-	s := make([]byte, n)
-	if n > 0 {
-		copy(s, md.buf[md.head:stop])
+func copyForm(m map[string]*vector.StringVector) map[string][]string {
+	form := make(map[string][]string)
+	for k, vec := range m {
+		form[k] = vec.Copy()
 	}
-
-	copy(md.buf[0:keep], md.buf[stop:md.tail])
-	md.head = 0
-	md.tail = keep
-
-	return s, nil
+	return form
 }
 
-func (md *multipartReader) readFirstLine() { md.readStringUntil(md.bd[2:len(md.bd)], false) }
-
-var crlf2 = []byte{'\r', '\n', '\r', '\n'}
-
-type byteConsumer func([]byte) os.Error
+// parseForm parses the query string, and, if eager is set, the body of the
+// request of env into its query, post form and uploads; form merges the
+// first two.  A body that isn't parsed is left to the controller in
+// bodyReader.  The body may not exceed limit bytes, unless limit is zero.
+func (a *Application) parseForm(env *env, eager bool, limit int64) os.Error {
+	r := env.request
+	q := make(map[string]*vector.StringVector)
+	m := make(map[string]*vector.StringVector)
+	u := make(map[string]*vector.Vector)
 
-func (md *multipartReader) readUntil(delim []byte, checkEnd bool, f byteConsumer) os.Error {
-	for {
-		b, e := md.read(delim)
-		if b != nil {
-			if e := f(b); e != nil {
-				return e
-			}
-		}
+	s := r.URL.RawQuery
+	if s != "" {
+		e := parseKeyValueString(q, s, 0)
 		if e != nil {
-			if e == os.EOF {
-				if checkEnd && md.tail-md.head >= 2 && string(md.buf[md.head:md.head+2]) == "--" {
-					md.done = true
-				}
-				break
-			}
 			return e
 		}
 	}
 
-	return nil
-}
-
-func (md *multipartReader) readStringUntil(delim []byte, checkEnd bool) (string, os.Error) {
-	var s string
-	e := md.readUntil(delim, checkEnd, func(b []byte) os.Error {
-		s += string(b)
-		return nil
-	})
-	return s, e
-}
-
-type hdrInfo struct {
-	key     string
-	val     string
-	attribs map[string]string
-}
-
-func parseHeader(line string) *hdrInfo {
-	var key, attrib string
-	var hdr *hdrInfo
-	var attribs map[string]string
-	var j int
-	phase := 0
-	line += ";"
-	for i, c := range line {
-		switch phase {
-		case 0:
-			if c == ':' {
-				key = strings.TrimSpace(line[0:i])
-				phase++
-				j = i + 1
-			}
-		case 1:
-			if c == ';' {
-				attribs = make(map[string]string)
-				hdr = &hdrInfo{
-					key:     key,
-					val:     strings.TrimSpace(line[j:i]),
-					attribs: attribs,
-				}
-				phase++
-				j = i + 1
+	if r.Method == "POST" || r.Method == "PUT" {
+		var rd io.Reader = r.Body
+		if limit > 0 {
+			if cl, e := strconv.Atoi64(r.Header.Get("Content-Length")); e == nil && cl > limit {
+				return errTooLarge("request body", limit)
 			}
-		case 2:
-			if c == '=' {
-				attrib = strings.TrimSpace(line[j:i])
-				phase++
-				j = i + 1
-			}
-		case 3:
-			if c == '"' {
-				phase++
-				j = i + 1
-			} else if c == ';' {
-				attribs[attrib] = strings.TrimSpace(line[j:i])
-				phase = 2
-				j = i + 1
-			}
-		case 4:
-			if c == '\\' {
-				phase++
-			} else if c == '"' {
-				attribs[attrib] = line[j:i]
-				phase += 2
-			}
-		case 5:
-			phase--
-		case 6:
-			if c == ';' {
-				phase = 2
-				j = i + 1
-			}
-		}
-	}
-	return hdr
-}
-
-func (md *multipartReader) readHeaders() (map[string]*hdrInfo, os.Error) {
-	s, _ := md.readStringUntil(crlf2, false)
-	lines := strings.Split(s[2:len(s)], "\r\n")
-	hdrs := make(map[string]*hdrInfo)
-	for _, line := range lines {
-		if hdr := parseHeader(line); hdr != nil {
-			hdrs[hdr.key] = hdr
-		}
-	}
-	return hdrs, nil
-}
-
-func (md *multipartReader) readBody() (string, os.Error) {
-	return md.readStringUntil(md.bd, true)
-}
-
-var pads = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-
-func tempfile() (*os.File, os.Error) {
-	tmpdir := os.Getenv("TMPDIR")
-	if tmpdir == "" {
-		tmpdir = "/tmp"
-	}
-
-	for {
-		var s string
-		for i := 0; i < 10; i++ {
-			s += string(pads[rand.Int()%len(pads)])
-		}
-		file, e := os.OpenFile(tmpdir+"/fastweb."+s, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if e == nil {
-			return file, e
-		}
-		pe, ok := e.(*os.PathError)
-		if !ok || pe.Error != os.EEXIST {
-			return nil, e
+			rd = &bodyLimiter{r: rd, left: limit, limit: limit}
 		}
-	}
-
-	return nil, nil
-}
-
-func parseMultipartForm(m map[string]*vector.StringVector, u map[string]*vector.Vector, r *fastcgi.Request) os.Error {
-	ct := r.Params["CONTENT_TYPE"]
-	a := boundaryRE.FindStringSubmatchIndex(ct)
-	if len(a) < 4 {
-		return os.NewError("can't find boundary in content type")
-	}
-	b := ct[a[2]:a[3]]
-	md := newMultipartReader(r.Stdin, b)
-	md.readFirstLine()
-	for !md.finished() {
-		hdrs, e := md.readHeaders()
-		if e != nil {
-			return e
-		}
-		cd, ok := hdrs["Content-Disposition"]
-		if !ok {
-			return os.NewError("can't find Content-Disposition")
-		}
-		name, ok := cd.attribs["name"]
-		if !ok {
-			return os.NewError("can't find attrib 'name' in Content-Disposition")
-		}
-		filename, ok := cd.attribs["filename"]
-		if ok {
-			vec, ok := u[name]
-			if !ok {
-				vec = new(vector.Vector)
-				u[name] = vec
-			}
 
-			file, e := tempfile()
+		switch ct := r.Header.Get("Content-Type"); true {
+		case !eager || r.Method != "POST":
+			env.bodyReader = rd
+		case strings.HasPrefix(ct, "application/x-www-form-urlencoded") && (len(ct) == 33 || ct[33] == ';'):
+			b, e := ioutil.ReadAll(rd)
 			if e != nil {
 				return e
 			}
-			wr := bufio.NewWriter(file)
-			fname := file.Name()
-			md.readUntil(md.bd, true, func(b []byte) os.Error {
-				if _, e := wr.Write(b); e != nil {
-					return e
-				}
-				return nil
-			})
-			wr.Flush()
-			// to flush (system) buffer, re-open immediately
-			file.Close()
-			file, _ = os.Open(fname)
-
-			vec.Push(&Upload{
-				File:     file,
-				Filename: filename,
-			})
-		} else {
-			vec, ok := m[name]
-			if !ok {
-				vec = new(vector.StringVector)
-				m[name] = vec
-			}
-			s, e := md.readBody()
+			env.body = string(b)
+			e = parseKeyValueString(m, env.body, a.MaxFieldSize)
 			if e != nil {
 				return e
 			}
-			vec.Push(s)
-		}
-	}
-	return nil
-}
-
-func parseForm(r *fastcgi.Request) (string, map[string][]string, map[string][]*Upload, os.Error) {
-	m := make(map[string]*vector.StringVector)
-	u := make(map[string]*vector.Vector)
-	var body string
-
-	s := r.Params["QUERY_STRING"]
-	if s != "" {
-		e := parseKeyValueString(m, s)
-		if e != nil {
-			return body, nil, nil, e
-		}
-	}
-
-	if r.Params["REQUEST_METHOD"] == "POST" {
-		switch ct := r.Params["CONTENT_TYPE"]; true {
-		case strings.HasPrefix(ct, "application/x-www-form-urlencoded") && (len(ct) == 33 || ct[33] == ';'):
-			var b []byte
-			var e os.Error
-			if b, e = ioutil.ReadAll(r.Stdin); e != nil {
-				return body, nil, nil, e
-			}
-			body = string(b)
-			e = parseKeyValueString(m, body)
-			if e != nil {
-				return body, nil, nil, e
-			}
 		case strings.HasPrefix(ct, "multipart/form-data"):
-			e := parseMultipartForm(m, u, r)
+			e := a.parseMultipartForm(m, u, r, rd)
 			if e != nil {
-				return body, nil, nil, e
+				discardUploads(u)
+				return e
 			}
 		default:
-			log.Printf("unknown content type '%s'", ct)
+			env.bodyReader = rd
 		}
 	}
 
-	form := make(map[string][]string)
-	for k, vec := range m {
-		form[k] = vec.Copy()
+	env.query = copyForm(q)
+	env.postForm = copyForm(m)
+	env.form = copyForm(q)
+	for k, v := range env.postForm {
+		env.form[k] = append(env.form[k], v...)
 	}
 
-	upload := make(map[string][]*Upload)
+	env.upload = make(map[string][]*Upload)
 	for k, vec := range u {
 		d := vec.Copy()
 		v := make([]*Upload, len(d))
 		for i, u := range d {
 			v[i] = u.(*Upload)
 		}
-		upload[k] = v
+		env.upload[k] = v
 	}
 
-	return body, form, upload, nil
+	return nil
 }
 
-func parseCookies(r *fastcgi.Request) (map[string]string, os.Error) {
+func parseCookies(r *Request) (map[string]string, os.Error) {
 	cookies := make(map[string]string)
 
-	if s, ok := r.Params["HTTP_COOKIE"]; ok {
+	if s := r.Header.Get("Cookie"); s != "" {
 		var key string
 		phase := 0
 		j := 0
@@ -791,19 +783,14 @@ func parseCookies(r *fastcgi.Request) (map[string]string, os.Error) {
 	return cookies, nil
 }
 
-func (a *Application) getEnv(r *fastcgi.Request) *env {
+func (a *Application) getEnv(w ResponseWriter, r *Request) *env {
 	var params []string
 	var lname string
 	var laction string
 
-	path, _ := r.Params["REQUEST_URI"]
-	p := strings.SplitN(path, "?", 2)
-	if len(p) > 1 {
-		path = p[0]
-		r.Params["QUERY_STRING"] = p[1]
-	}
+	path := r.URL.Path
 
-	pparts := strings.Split(path, "/")
+	pparts := pathSegments(r.URL)
 	n := len(pparts)
 	if n > 1 {
 		lname = pparts[1]
@@ -821,11 +808,6 @@ func (a *Application) getEnv(r *fastcgi.Request) *env {
 	name := titleCase(lname)
 	action := titleCase(laction)
 
-	body, form, upload, e := parseForm(r)
-	if e != nil {
-		log.Printf("failed to parse form: %s", e.String())
-	}
-
 	cookies, e := parseCookies(r)
 	if e != nil {
 		log.Printf("failed to parse cookies: %s", e.String())
@@ -838,16 +820,15 @@ func (a *Application) getEnv(r *fastcgi.Request) *env {
 		action:      action,
 		laction:     laction,
 		params:      params,
+		app:         a,
 		request:     r,
-		body:        body,
-		form:        form,
-		upload:      upload,
+		response:    newResponseBuffer(w),
 		cookies:     cookies,
 	}
 }
 
-func (a *Application) route(r *fastcgi.Request) os.Error {
-	env := a.getEnv(r)
+func (a *Application) route(w ResponseWriter, r *Request) os.Error {
+	env := a.getEnv(w, r)
 
 	if env.controller == "" {
 		env.controller = a.defaultController
@@ -878,6 +859,18 @@ func (a *Application) route(r *fastcgi.Request) os.Error {
 		return NewError("PageNotFound", "not enough parameter")
 	}
 
+	limit := c.BodyLimit(env.action)
+	if limit < 0 {
+		limit = a.MaxBodySize
+	}
+	if e := a.parseForm(env, c.ParseBody(env.action), limit); e != nil {
+		if ee, ok := e.(Error); ok && ee.Type() == "RequestEntityTooLarge" {
+			return e
+		}
+		log.Printf("failed to parse form: %s", e.String())
+	}
+	defer cleanupUploads(env.upload)
+
 	pv := make([]reflect.Value, minfo.nparams+1)
 	pv[0] = vc
 
@@ -903,19 +896,63 @@ func (a *Application) route(r *fastcgi.Request) os.Error {
 	eval := minfo.method.Call(pv)[0]
 	if !eval.IsNil() {
 		elemval := eval.Elem()
-		return unsafe.Unreflect(elemval.Type(), unsafe.Pointer(elemval.UnsafeAddr())).(os.Error)
+		e := unsafe.Unreflect(elemval.Type(), unsafe.Pointer(elemval.UnsafeAddr())).(os.Error)
+		if env.response.committed {
+			// part of the response is out already, an error page can't
+			// follow it
+			log.Printf("%s", e.String())
+			return nil
+		}
+		// nothing of this response has been sent, not even its
+		// headers; the error page gets a buffer of its own
+		return e
 	}
 
-	c.SetContext(c)
-	c.Render()
+	cc, _ := c.(conditional)
+	if cc != nil && cc.notModified() {
+		env.response.notModified()
+	} else {
+		c.SetContext(c)
+		c.Render()
+		if cc != nil && cc.notModifiedBody() {
+			env.response.notModified()
+		}
+	}
 
 	c.CloseSession()
 
+	if e := env.response.finish(); e != nil {
+		log.Printf("failed to write response: %s", e.String())
+	}
+
 	return nil
 }
 
-func (a *Application) Handle(r *fastcgi.Request) bool {
-	e := a.route(r)
+// ServeRequest routes r to its controller and writes the response to w.
+// Handle and ServeHTTP adapt their requests and call it; it can also be
+// called directly, with a ResponseRecorder, to test controllers.
+func (a *Application) ServeRequest(w ResponseWriter, r *Request) {
+	if !a.enter() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer a.leave()
+
+	if a.serveStatic(w, r) {
+		return
+	}
+
+	if a.compress != nil {
+		cw := newCompressWriter(w, r, a.compress)
+		defer func() {
+			if e := cw.close(); e != nil {
+				log.Printf("compress: %s", e.String())
+			}
+		}()
+		w = cw
+	}
+
+	e := a.route(w, r)
 
 	if e != nil {
 		var ee Error
@@ -925,20 +962,68 @@ func (a *Application) Handle(r *fastcgi.Request) bool {
 			ee = NewError("Generic", e.String())
 		}
 		log.Printf("%s", e.String())
-		eh := NewErrorHandler(ee, r)
+		eh := a.NewErrorHandler(ee, w, r)
 		eh.Render()
+		eh.out.finish()
 	}
+}
 
+// Handle serves a request received by the fastcgi package.
+func (a *Application) Handle(r *fastcgi.Request) bool {
+	a.handleFcgi(r.Stdout, r.Params, r.Stdin)
 	return true
 }
 
+// handleFcgi serves a FastCGI request, from Handle or from Run, given its
+// parameters and body, and writes the response to out.
+func (a *Application) handleFcgi(out io.Writer, params map[string]string, stdin io.Reader) {
+	w := newFcgiResponseWriter(out)
+	req, e := newFcgiRequest(params, stdin)
+	if e != nil {
+		log.Printf("bad request: %s", e.String())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	a.ServeRequest(w, req)
+}
+
+// ServeHTTP makes Application a http.Handler, so that it can be served by
+// the http package directly, without a FastCGI front end.
+func (a *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.ServeRequest(w, newHTTPRequest(r))
+}
+
 func NewApplication() *Application {
 	return &Application{
 		controllerMap:     make(map[string]*controllerInfo),
 		defaultController: "Default",
+		ShutdownTimeout:   30e9,
+		SocketMode:        0660,
+		MaxBodySize:       defaultMaxBodySize,
+		MaxFileSize:       defaultMaxFileSize,
+		MaxFieldSize:      defaultMaxFieldSize,
+		MaxParts:          defaultMaxParts,
+		done:              make(chan bool),
+		viewsRoot:         "views",
+		fs:                OSFileSystem{},
+		tmplCache:         make(map[string]*tmplInfo),
 	}
 }
 
+// AddFunc makes fn callable from the views of the application, as in
+// <%price(Product.Price, "EUR")|html%>.  Functions must be added before
+// the views using them are loaded.
+func (a *Application) AddFunc(name string, fn interface{}) os.Error {
+	if e := checkFunc(name, fn); e != nil {
+		return e
+	}
+	if a.funcs == nil {
+		a.funcs = make(FuncMap)
+	}
+	a.funcs[name] = fn
+	return nil
+}
+
 func (a *Application) RegisterController(c ControllerInterface) {
 	v := reflect.ValueOf(c)
 	pt := v.Type()
@@ -996,9 +1081,8 @@ func (a *Application) RegisterController(c ControllerInterface) {
 		controllerPtrType: pt,
 		methodMap:         mmap,
 	}
-}
 
-func (a *Application) Run(addr string) os.Error {
-	rand.Seed(time.Nanoseconds())
-	return fastcgi.RunStandalone(addr, a)
+	if a.VerifyViews {
+		logViewErrors(a.CheckViews(c))
+	}
 }
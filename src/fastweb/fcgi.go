@@ -0,0 +1,257 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// The FastCGI responder behind Run.  It hands the parameters of each
+// request to the same code as Handle, so that a request reads the same
+// whether it came through Run or through the fastcgi package.
+
+// Record types.
+const (
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+	fcgiUnknownType     = 11
+)
+
+const (
+	fcgiVersion     = 1
+	fcgiResponder   = 1 // the only role served
+	fcgiKeepConn    = 1 // flag of fcgiBeginRequest
+	fcgiComplete    = 0 // protocol status of fcgiEndRequest
+	fcgiUnknownRole = 3
+	fcgiMaxContent  = 65535
+)
+
+type fcgiRequest struct {
+	id       uint16
+	keepConn bool
+	params   []byte
+	stdin    *io.PipeWriter
+}
+
+type fcgiConn struct {
+	app      *Application
+	rwc      io.ReadWriteCloser
+	wlock    sync.Mutex // held while writing a record
+	lock     sync.Mutex // protects requests
+	requests map[uint16]*fcgiRequest
+}
+
+// fcgiServe serves a over FastCGI on the connections accepted by l.
+func fcgiServe(l net.Listener, a *Application) os.Error {
+	for {
+		rwc, e := l.Accept()
+		if e != nil {
+			return e
+		}
+		c := &fcgiConn{
+			app:      a,
+			rwc:      rwc,
+			requests: make(map[uint16]*fcgiRequest),
+		}
+		go c.serve()
+	}
+	panic("unreachable")
+}
+
+func (c *fcgiConn) serve() {
+	defer c.rwc.Close()
+	r := bufio.NewReader(c.rwc)
+	var h [8]byte
+	for {
+		if _, e := io.ReadFull(r, h[:]); e != nil {
+			break
+		}
+		if h[0] != fcgiVersion {
+			break
+		}
+		t := h[1]
+		id := uint16(h[2])<<8 | uint16(h[3])
+		n := int(h[4])<<8 | int(h[5])
+		content := make([]byte, n+int(h[6]))
+		if _, e := io.ReadFull(r, content); e != nil {
+			break
+		}
+		if !c.handleRecord(t, id, content[0:n]) {
+			break
+		}
+	}
+	// the bodies of the requests left can't be complete
+	c.lock.Lock()
+	for _, req := range c.requests {
+		if req.stdin != nil {
+			req.stdin.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}
+	c.lock.Unlock()
+}
+
+// handleRecord handles a record read from the connection.  It returns
+// false if the connection is to be closed.
+func (c *fcgiConn) handleRecord(t uint8, id uint16, content []byte) bool {
+	if id == 0 {
+		switch t {
+		case fcgiGetValues:
+			// nothing is told about the variables asked for
+			return c.writeRecord(fcgiGetValuesResult, 0, nil) == nil
+		}
+		return c.writeRecord(fcgiUnknownType, 0, []byte{t, 0, 0, 0, 0, 0, 0, 0}) == nil
+	}
+	c.lock.Lock()
+	req := c.requests[id]
+	c.lock.Unlock()
+	switch t {
+	case fcgiBeginRequest:
+		if len(content) < 3 {
+			return false
+		}
+		if role := uint16(content[0])<<8 | uint16(content[1]); role != fcgiResponder {
+			return c.endRequest(id, fcgiUnknownRole) == nil
+		}
+		c.lock.Lock()
+		c.requests[id] = &fcgiRequest{id: id, keepConn: content[2]&fcgiKeepConn != 0}
+		c.lock.Unlock()
+	case fcgiParams:
+		if req == nil || req.stdin != nil {
+			break
+		}
+		if len(content) > 0 {
+			req.params = append(req.params, content...)
+			break
+		}
+		params, e := fcgiParseParams(req.params)
+		if e != nil {
+			return false
+		}
+		req.params = nil
+		body, w := io.Pipe()
+		req.stdin = w
+		go c.handle(req, params, body)
+	case fcgiStdin:
+		if req == nil || req.stdin == nil {
+			break
+		}
+		if len(content) == 0 {
+			req.stdin.Close()
+			break
+		}
+		// fails once the handler is done, which need not read it all
+		req.stdin.Write(content)
+	case fcgiAbortRequest:
+		if req == nil {
+			break
+		}
+		if req.stdin == nil {
+			c.lock.Lock()
+			c.requests[id] = nil, false
+			c.lock.Unlock()
+			return c.endRequest(id, fcgiComplete) == nil && req.keepConn
+		}
+		req.stdin.CloseWithError(os.NewError("request aborted"))
+	}
+	return true
+}
+
+func (c *fcgiConn) handle(req *fcgiRequest, params map[string]string, body *io.PipeReader) {
+	out := bufio.NewWriter(&fcgiStdoutWriter{c, req.id})
+	c.app.handleFcgi(out, params, body)
+	out.Flush()
+	body.Close()
+
+	c.lock.Lock()
+	c.requests[req.id] = nil, false
+	c.lock.Unlock()
+	c.writeRecord(fcgiStdout, req.id, nil)
+	c.endRequest(req.id, fcgiComplete)
+	if !req.keepConn {
+		c.rwc.Close()
+	}
+}
+
+func (c *fcgiConn) endRequest(id uint16, status uint8) os.Error {
+	return c.writeRecord(fcgiEndRequest, id, []byte{0, 0, 0, 0, status, 0, 0, 0})
+}
+
+func (c *fcgiConn) writeRecord(t uint8, id uint16, content []byte) os.Error {
+	pad := -len(content) & 7
+	var b bytes.Buffer
+	b.Write([]byte{fcgiVersion, t, byte(id >> 8), byte(id), byte(len(content) >> 8), byte(len(content)), byte(pad), 0})
+	b.Write(content)
+	b.Write(make([]byte, pad))
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, e := c.rwc.Write(b.Bytes())
+	return e
+}
+
+// fcgiStdoutWriter writes the response of a request as fcgiStdout records.
+type fcgiStdoutWriter struct {
+	c  *fcgiConn
+	id uint16
+}
+
+func (w *fcgiStdoutWriter) Write(p []byte) (int, os.Error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > fcgiMaxContent {
+			chunk = chunk[0:fcgiMaxContent]
+		}
+		if e := w.c.writeRecord(fcgiStdout, w.id, chunk); e != nil {
+			return n, e
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// fcgiParseParams decodes the name-value pairs of fcgiParams records.
+func fcgiParseParams(b []byte) (map[string]string, os.Error) {
+	params := make(map[string]string)
+	for len(b) > 0 {
+		var nlen, vlen int
+		var ok bool
+		if nlen, b, ok = fcgiParamLen(b); !ok {
+			return nil, os.NewError("bad FastCGI parameters")
+		}
+		if vlen, b, ok = fcgiParamLen(b); !ok || nlen+vlen > len(b) {
+			return nil, os.NewError("bad FastCGI parameters")
+		}
+		params[string(b[0:nlen])] = string(b[nlen : nlen+vlen])
+		b = b[nlen+vlen:]
+	}
+	return params, nil
+}
+
+// fcgiParamLen reads a length of one byte, or of four bytes if the high bit
+// of the first one is set.
+func fcgiParamLen(b []byte) (int, []byte, bool) {
+	if len(b) == 0 {
+		return 0, b, false
+	}
+	if b[0]&0x80 == 0 {
+		return int(b[0]), b[1:], true
+	}
+	if len(b) < 4 {
+		return 0, b, false
+	}
+	return int(b[0]&0x7f)<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3]), b[4:], true
+}
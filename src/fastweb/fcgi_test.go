@@ -0,0 +1,27 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFcgiParams(t *testing.T) {
+	long := strings.Repeat("v", 200)
+	b := "\x0b\x02SERVER_NAMEab" + "\x05\x80\x00\x00\xc8HTTPS" + long + "\x00\x00"
+	params, e := fcgiParseParams([]byte(b))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(params) != 3 || params["SERVER_NAME"] != "ab" || params["HTTPS"] != long {
+		t.Errorf("bad parameters %v", params)
+	}
+	for _, b := range []string{"\x05\x03HTTPSon", "\x05", "\x80\x00\x00", "\x01\x80\x00\x00\x01a"} {
+		if _, e := fcgiParseParams([]byte(b)); e == nil {
+			t.Errorf("%q: truncated parameters accepted", b)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FormValue returns the first value of the form field name, "" if there is
+// none.
+func (c *Controller) FormValue(name string) string {
+	if v := c.Form[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// FormDefault returns the first value of the form field name, or def if the
+// field is missing.
+func (c *Controller) FormDefault(name string, def string) string {
+	if v := c.Form[name]; len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+func (c *Controller) formValue(name string) (string, os.Error) {
+	if v := c.Form[name]; len(v) > 0 {
+		return v[0], nil
+	}
+	return "", os.NewError("form field '" + name + "' is missing")
+}
+
+// FormInt returns the first value of the form field name as an int.
+func (c *Controller) FormInt(name string) (int, os.Error) {
+	s, e := c.formValue(name)
+	if e != nil {
+		return 0, e
+	}
+	return strconv.Atoi(strings.TrimSpace(s))
+}
+
+// FormFloat returns the first value of the form field name as a float64.
+func (c *Controller) FormFloat(name string) (float64, os.Error) {
+	s, e := c.formValue(name)
+	if e != nil {
+		return 0, e
+	}
+	return strconv.Atof64(strings.TrimSpace(s))
+}
+
+// FormBool returns the first value of the form field name as a bool.  On
+// top of what strconv.Atob accepts, "on", "yes", "off", "no" and "" (as
+// sent by check boxes and empty inputs) are understood.
+func (c *Controller) FormBool(name string) (bool, os.Error) {
+	s, e := c.formValue(name)
+	if e != nil {
+		return false, e
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "on", "yes":
+		return true, nil
+	case "off", "no", "":
+		return false, nil
+	}
+	return strconv.Atob(s)
+}
+
+// NestedForm decodes the form fields with bracketed names into nested
+// values.  For example
+//
+//	items[0][name]=a&items[0][qty]=1&items[1][name]=b&tags[]=x&tags[]=y
+//
+// gives items as a []interface{} of two map[string]interface{}, and tags as
+// a []interface{} of two strings.  Maps whose keys are all integers become
+// slices, ordered by key.  A leaf holds a string, or a []string if the
+// field has several values.  Fields are decoded in the order of their
+// names, and each [] appends after the highest index given so far, so
+// that a[0]=x&a[]=y gives x, y.
+func (c *Controller) NestedForm() (map[string]interface{}, os.Error) {
+	return decodeNestedForm(c.Form)
+}
+
+func decodeNestedForm(form map[string][]string) (map[string]interface{}, os.Error) {
+	root := newFormNode()
+	names := make([]string, 0, len(form))
+	for name := range form {
+		names = append(names, name)
+	}
+	// explicit indexes sort before [], as digits come before ']'
+	sort.Strings(names)
+	for _, name := range names {
+		path := splitFormName(name)
+		for _, v := range form[name] {
+			if e := insertNested(root, path, v); e != nil {
+				return nil, e
+			}
+		}
+	}
+	m := make(map[string]interface{})
+	for k, v := range root.m {
+		m[k] = nestedSlices(v)
+	}
+	return m, nil
+}
+
+// splitFormName splits a[b][c] into a, b, c.  Names that aren't well formed
+// are taken as they are.
+func splitFormName(name string) []string {
+	i := strings.Index(name, "[")
+	if i <= 0 {
+		return []string{name}
+	}
+	path := []string{name[0:i]}
+	for rest := name[i:]; len(rest) > 0; {
+		j := strings.Index(rest, "]")
+		if rest[0] != '[' || j < 0 {
+			return []string{name}
+		}
+		path = append(path, rest[1:j])
+		rest = rest[j+1:]
+	}
+	return path
+}
+
+// formNode is a map of the form being decoded, with the index the next []
+// in it takes.
+type formNode struct {
+	m    map[string]interface{}
+	next int
+}
+
+func newFormNode() *formNode {
+	return &formNode{m: make(map[string]interface{})}
+}
+
+func insertNested(node *formNode, path []string, value string) os.Error {
+	for i, key := range path {
+		if key == "" {
+			// a[] appends
+			key = strconv.Itoa(node.next)
+		}
+		if n, e := strconv.Atoi(key); e == nil && n >= node.next {
+			node.next = n + 1
+		}
+		old, ok := node.m[key]
+		if i == len(path)-1 {
+			switch o := old.(type) {
+			case nil:
+				node.m[key] = value
+			case string:
+				node.m[key] = []string{o, value}
+			case []string:
+				node.m[key] = append(o, value)
+			default:
+				return os.NewError("form field '" + strings.Join(path, ".") + "' is both a value and a list")
+			}
+			return nil
+		}
+		if !ok {
+			old = newFormNode()
+			node.m[key] = old
+		}
+		sub, ok := old.(*formNode)
+		if !ok {
+			return os.NewError("form field '" + strings.Join(path, ".") + "' is both a value and a list")
+		}
+		node = sub
+	}
+	return nil
+}
+
+// nestedSlices turns the nodes within v into maps, or into slices if their
+// keys are all integers.
+func nestedSlices(v interface{}) interface{} {
+	node, ok := v.(*formNode)
+	if !ok {
+		return v
+	}
+	m := node.m
+	keys := make(map[int]string)
+	idx := make([]int, 0, len(m))
+	for k, sub := range m {
+		m[k] = nestedSlices(sub)
+		if n, e := strconv.Atoi(k); e == nil && n >= 0 {
+			if _, dup := keys[n]; !dup {
+				keys[n] = k
+				idx = append(idx, n)
+			}
+		}
+	}
+	if len(idx) != len(m) || len(m) == 0 {
+		return m
+	}
+	sort.Ints(idx)
+	a := make([]interface{}, len(idx))
+	for i, n := range idx {
+		a[i] = m[keys[n]]
+	}
+	return a
+}
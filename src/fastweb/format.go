@@ -10,6 +10,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"url"
 )
 
 // StringFormatter formats into the default string representation.
@@ -77,33 +82,32 @@ func HTMLFormatter(w io.Writer, format string, value ...interface{}) {
 }
 
 var (
-	jesc_quot = []byte("\\\"") // shorter than "&quot;"
-	jesc_apos = []byte("\\'") // shorter than "&apos;"
-	jesc_bs = []byte("\\\\")
-	jesc_tab = []byte("\\t")
-	jesc_cr = []byte("\\r")
-	jesc_lf = []byte("\\n")
+	jesc_quot = []byte("\\\"")
+	jesc_bs   = []byte("\\\\")
+	jesc_tab  = []byte("\\t")
+	jesc_cr   = []byte("\\r")
+	jesc_lf   = []byte("\\n")
 )
 
 // JSONEscape writes to w the properly escaped JSON equivalent
-// of the plain text data s.
+// of the plain text data s, without the quotes around it.
 func JSONEscape(w io.Writer, s []byte) {
 	var esc []byte
 	last := 0
 	for i, c := range s {
-		switch c {
-		case '"':
+		switch {
+		case c == '"':
 			esc = jesc_quot
-		case '\'':
-			esc = jesc_apos
-		case '\\':
+		case c == '\\':
 			esc = jesc_bs
-		case '\t':
+		case c == '\t':
 			esc = jesc_tab
-		case '\r':
+		case c == '\r':
 			esc = jesc_cr
-		case '\n':
+		case c == '\n':
 			esc = jesc_lf
+		case c < ' ':
+			esc = []byte(fmt.Sprintf("\\u%04x", c))
 		default:
 			continue
 		}
@@ -114,17 +118,280 @@ func JSONEscape(w io.Writer, s []byte) {
 	w.Write(s[last:])
 }
 
-// JSONFormatter formats arbitrary values for HTML
-func JSONFormatter(w io.Writer, format string, value ...interface{}) {
-	ok := false
-	var b []byte
+// formatValue returns the value a formatter applies to: the single value
+// passed, as a string if it is the output of a previous formatter.
+func formatValue(value []interface{}) interface{} {
 	if len(value) == 1 {
-		b, ok = value[0].([]byte)
+		if b, ok := value[0].([]byte); ok {
+			return string(b)
+		}
+		return value[0]
+	}
+	return fmt.Sprint(value...)
+}
+
+// formatString returns the value a formatter applies to as a string.
+func formatString(value []interface{}) string {
+	if v, ok := formatValue(value).(string); ok {
+		return v
+	}
+	return fmt.Sprint(value...)
+}
+
+// formatNumber returns the value a formatter applies to as a number, and
+// whether it is one.
+func formatNumber(value []interface{}) (float64, bool) {
+	v := indirect(reflect.ValueOf(formatValue(value)))
+	switch cmpClass(v) {
+	case cmpInt, cmpUint, cmpFloat:
+		return toFloat(v), true
+	case cmpString:
+		f, e := strconv.Atof64(strings.TrimSpace(v.String()))
+		return f, e == nil
 	}
+	return 0, false
+}
+
+// intArg returns the argument i of the formatter invocation format as an
+// int, def if there is no such argument or it isn't a number.
+func intArg(format string, i int, def int) int {
+	args := FormatterArgs(format)
+	if i >= len(args) {
+		return def
+	}
+	n, e := strconv.Atoi(args[i])
+	if e != nil {
+		return def
+	}
+	return n
+}
+
+// JSONFormatter formats arbitrary values as JSON.  <, > and & are escaped
+// so that the output can be put in a script element.  Strings are written
+// with their quotes, which the formatter used to leave out: a template
+// giving "<%X|json%>" now writes them twice and must drop its own.
+func JSONFormatter(w io.Writer, format string, value ...interface{}) {
+	jsValue(w, formatValue(value))
+}
+
+// JSFormatter escapes values for a JavaScript string literal.
+func JSFormatter(w io.Writer, format string, value ...interface{}) {
+	jsStrEscape(w, []byte(formatString(value)))
+}
+
+// CSSFormatter writes values that are harmless CSS values, like keywords,
+// lengths or colors, and ZfastwebZ in place of others.
+func CSSFormatter(w io.Writer, format string, value ...interface{}) {
+	cssValueFilter(w, []byte(formatString(value)))
+}
+
+// AttrFormatter escapes values for HTML attributes, quoted or not.
+func AttrFormatter(w io.Writer, format string, value ...interface{}) {
+	attrEscape(w, []byte(formatString(value)))
+}
+
+// URLFormatter writes values as URLs, percent-encoding the bytes that
+// can't appear in one.  URLs with schemes other than http, https and mailto
+// are replaced with #ZfastwebZ.
+func URLFormatter(w io.Writer, format string, value ...interface{}) {
+	b := []byte(formatString(value))
+	if !safeURL(b) {
+		io.WriteString(w, "#ZfastwebZ")
+		return
+	}
+	urlNormalize(w, b)
+}
+
+// URLQueryFormatter escapes values for the query of a URL.
+func URLQueryFormatter(w io.Writer, format string, value ...interface{}) {
+	io.WriteString(w, url.QueryEscape(formatString(value)))
+}
+
+// Named layouts of the date and time formatters.
+var timeLayouts = map[string]string{
+	"ANSIC":    time.ANSIC,
+	"UnixDate": time.UnixDate,
+	"RubyDate": time.RubyDate,
+	"RFC822":   time.RFC822,
+	"RFC822Z":  time.RFC822Z,
+	"RFC850":   time.RFC850,
+	"RFC1123":  time.RFC1123,
+	"RFC1123Z": time.RFC1123Z,
+	"RFC3339":  time.RFC3339,
+	"Kitchen":  time.Kitchen,
+}
+
+// TimeFormatter formats *time.Time and time.Time values, and integers as
+// seconds since the epoch in local time.  Its argument is the layout, as
+// for time.Format, or the name of one of the layouts of the time package,
+// like RFC3339.  Without one, "date" writes 2006-01-02 and "time"
+// 15:04:05.
+func TimeFormatter(w io.Writer, format string, value ...interface{}) {
+	var t *time.Time
+	switch v := formatValue(value).(type) {
+	case *time.Time:
+		t = v
+	case time.Time:
+		t = &v
+	default:
+		rv := reflect.ValueOf(v)
+		switch cmpClass(rv) {
+		case cmpInt:
+			t = time.SecondsToLocalTime(rv.Int())
+		case cmpUint:
+			t = time.SecondsToLocalTime(int64(rv.Uint()))
+		}
+	}
+	if t == nil {
+		StringFormatter(w, format, value...)
+		return
+	}
+	layout := "2006-01-02"
+	if formatterName(format) == "time" {
+		layout = "15:04:05"
+	}
+	if args := FormatterArgs(format); len(args) > 0 {
+		layout = args[0]
+		if l, ok := timeLayouts[layout]; ok {
+			layout = l
+		}
+	}
+	io.WriteString(w, t.Format(layout))
+}
+
+// groupDigits writes the number f with decimals digits after the point,
+// the shortest representation if decimals is negative, and commas between
+// groups of thousands.
+func groupDigits(f float64, decimals int) string {
+	s := strconv.Ftoa64(f, 'f', decimals)
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	frac := ""
+	if i := strings.Index(s, "."); i >= 0 {
+		s, frac = s[0:i], s[i:]
+	}
+	var buf bytes.Buffer
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(byte(c))
+	}
+	return sign + buf.String() + frac
+}
+
+// NumberFormatter writes numbers with commas between groups of thousands.
+// Its argument is the number of decimals, as in number:2; without one,
+// numbers are written as short as possible.
+func NumberFormatter(w io.Writer, format string, value ...interface{}) {
+	f, ok := formatNumber(value)
 	if !ok {
-		var buf bytes.Buffer
-		fmt.Fprint(&buf, value...)
-		b = buf.Bytes()
+		StringFormatter(w, format, value...)
+		return
+	}
+	io.WriteString(w, groupDigits(f, intArg(format, 0, -1)))
+}
+
+// CurrencyFormatter writes amounts of money, like number does, after a
+// currency symbol given as first argument.  The second argument is the
+// number of decimals, 2 by default, as in currency:"$" or currency:"¥",0.
+func CurrencyFormatter(w io.Writer, format string, value ...interface{}) {
+	f, ok := formatNumber(value)
+	if !ok {
+		StringFormatter(w, format, value...)
+		return
+	}
+	symbol := ""
+	if args := FormatterArgs(format); len(args) > 0 {
+		symbol = args[0]
+	}
+	s := groupDigits(f, intArg(format, 1, 2))
+	if s[0] == '-' {
+		io.WriteString(w, "-"+symbol+s[1:])
+		return
+	}
+	io.WriteString(w, symbol+s)
+}
+
+// TruncateFormatter shortens values to the number of characters given as
+// first argument, appending the second argument, "..." by default, to the
+// values it shortens, as in truncate:40 or truncate:40,"".
+func TruncateFormatter(w io.Writer, format string, value ...interface{}) {
+	s := formatString(value)
+	n := intArg(format, 0, -1)
+	if r := []int(s); n >= 0 && len(r) > n {
+		tail := "..."
+		if args := FormatterArgs(format); len(args) > 1 {
+			tail = args[1]
+		}
+		s = string(r[0:n]) + tail
+	}
+	io.WriteString(w, s)
+}
+
+// UpperFormatter writes values in upper case.
+func UpperFormatter(w io.Writer, format string, value ...interface{}) {
+	io.WriteString(w, strings.ToUpper(formatString(value)))
+}
+
+// LowerFormatter writes values in lower case.
+func LowerFormatter(w io.Writer, format string, value ...interface{}) {
+	io.WriteString(w, strings.ToLower(formatString(value)))
+}
+
+// TitleFormatter writes values with the first letter of each word in
+// upper case.
+func TitleFormatter(w io.Writer, format string, value ...interface{}) {
+	io.WriteString(w, strings.Title(formatString(value)))
+}
+
+// Nl2brFormatter escapes values for HTML, and breaks lines with <br>
+// where they have newlines.
+func Nl2brFormatter(w io.Writer, format string, value ...interface{}) {
+	var buf bytes.Buffer
+	HTMLEscape(&buf, []byte(formatString(value)))
+	s := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	io.WriteString(w, strings.Replace(s, "\n", "<br>\n", -1))
+}
+
+// DefaultFormatter writes its argument in place of empty values: nil,
+// false, zero, and empty strings, slices and maps; as in default:"n/a".
+func DefaultFormatter(w io.Writer, format string, value ...interface{}) {
+	if !empty(reflect.ValueOf(formatValue(value))) {
+		StringFormatter(w, format, value...)
+		return
+	}
+	if args := FormatterArgs(format); len(args) > 0 {
+		io.WriteString(w, args[0])
+	}
+}
+
+// PluralizeFormatter writes a suffix for a count: "" for one and "s" for
+// others, as in "<%N%> item<%N|pluralize%>".  With an argument, it is the
+// plural suffix; with two, they are the singular and the plural one, as in
+// "entr<%N|pluralize:"y","ies"%>".  Slices and maps count their items.
+func PluralizeFormatter(w io.Writer, format string, value ...interface{}) {
+	singular, plural := "", "s"
+	switch args := FormatterArgs(format); len(args) {
+	case 0:
+	case 1:
+		plural = args[0]
+	default:
+		singular, plural = args[0], args[1]
+	}
+	n, ok := formatNumber(value)
+	if !ok {
+		v := indirect(reflect.ValueOf(formatValue(value)))
+		switch v.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+			n = float64(v.Len())
+		}
+	}
+	if n == 1 {
+		io.WriteString(w, singular)
+	} else {
+		io.WriteString(w, plural)
 	}
-	JSONEscape(w, b)
 }
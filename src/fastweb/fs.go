@@ -0,0 +1,332 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileSystem is where an application reads its views and static files
+// from.  Names are slash-separated and relative, as in
+// "views/products/view.tpl".
+type FileSystem interface {
+	Open(name string) (File, os.Error)
+	Stat(name string) (*os.FileInfo, os.Error)
+}
+
+// File is a file opened from a FileSystem.  *os.File implements it.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Readdir(count int) ([]os.FileInfo, os.Error)
+}
+
+// OSFileSystem reads the files of the operating system, relative to the
+// working directory.  It is the file system of a new Application.
+type OSFileSystem struct{}
+
+func (OSFileSystem) Open(name string) (File, os.Error) {
+	f, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	return f, nil
+}
+
+func (OSFileSystem) Stat(name string) (*os.FileInfo, os.Error) {
+	return os.Stat(name)
+}
+
+// SetFileSystem makes the application read its views and static files from
+// fs.  Templates loaded so far are dropped.
+func (a *Application) SetFileSystem(fs FileSystem) {
+	a.tmplLock.Lock()
+	a.fs = fs
+	a.tmplCache = make(map[string]*tmplInfo)
+	a.tmplLock.Unlock()
+}
+
+// readFile reads the whole file name of fs.
+func readFile(fs FileSystem, name string) ([]byte, os.Error) {
+	f, e := fs.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// MemFileSystem holds files in memory, for tests and for applications
+// built into a single binary with their views and static files.
+// Directories exist implicitly, as the parents of the files added.
+type MemFileSystem struct {
+	lock  sync.RWMutex
+	files map[string]*memEntry
+}
+
+type memEntry struct {
+	fi   os.FileInfo
+	data []byte
+}
+
+// NewMemFileSystem returns an empty MemFileSystem.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{files: make(map[string]*memEntry)}
+}
+
+// cleanMemPath returns the key of name in a MemFileSystem, "" for the
+// root.
+func cleanMemPath(name string) string {
+	name = path.Clean("/" + name)
+	return name[1:]
+}
+
+// Add adds the file name holding data, modified now, replacing the file
+// of that name if any.
+func (m *MemFileSystem) Add(name string, data []byte) {
+	m.AddFile(name, data, time.Nanoseconds())
+}
+
+// AddFile adds the file name holding data, modified at mtime nanoseconds,
+// replacing the file of that name if any.
+func (m *MemFileSystem) AddFile(name string, data []byte, mtime int64) {
+	name = cleanMemPath(name)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.files[name] = &memEntry{
+		fi: os.FileInfo{
+			Name:     path.Base(name),
+			Mode:     syscall.S_IFREG | 0444,
+			Size:     int64(len(data)),
+			Mtime_ns: mtime,
+		},
+		data: data,
+	}
+}
+
+// Remove removes the file name.
+func (m *MemFileSystem) Remove(name string) {
+	m.lock.Lock()
+	m.files[cleanMemPath(name)] = nil, false
+	m.lock.Unlock()
+}
+
+func (m *MemFileSystem) Stat(name string) (*os.FileInfo, os.Error) {
+	name = cleanMemPath(name)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if f, ok := m.files[name]; ok {
+		fi := f.fi
+		return &fi, nil
+	}
+	if _, ok := m.children(name); ok {
+		return memDirInfo(name), nil
+	}
+	return nil, &os.PathError{"stat", name, os.ENOENT}
+}
+
+func (m *MemFileSystem) Open(name string) (File, os.Error) {
+	name = cleanMemPath(name)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if f, ok := m.files[name]; ok {
+		return &memFile{data: f.data}, nil
+	}
+	if entries, ok := m.children(name); ok {
+		return &memFile{entries: entries}, nil
+	}
+	return nil, &os.PathError{"open", name, os.ENOENT}
+}
+
+// children returns the entries of the directory dir, sorted by name, and
+// whether there is such a directory.
+func (m *MemFileSystem) children(dir string) ([]os.FileInfo, bool) {
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	seen := make(map[string]bool)
+	var names []string
+	entries := make(map[string]os.FileInfo)
+	found := false
+	for name, f := range m.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		found = true
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[0:i]
+			entries[rest] = *memDirInfo(prefix + rest)
+		} else {
+			entries[rest] = f.fi
+		}
+		if !seen[rest] {
+			seen[rest] = true
+			names = append(names, rest)
+		}
+	}
+	sort.Strings(names)
+	fis := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		fis[i] = entries[name]
+	}
+	return fis, found
+}
+
+func memDirInfo(name string) *os.FileInfo {
+	return &os.FileInfo{
+		Name: path.Base("/" + name),
+		Mode: syscall.S_IFDIR | 0555,
+	}
+}
+
+// memFile is an open file or directory of a MemFileSystem.
+type memFile struct {
+	data    []byte
+	off     int64
+	entries []os.FileInfo // for a directory
+}
+
+func (f *memFile) Read(b []byte) (int, os.Error) {
+	if f.off >= int64(len(f.data)) {
+		return 0, os.EOF
+	}
+	n := copy(b, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 1:
+		offset += f.off
+	case 2:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, os.EINVAL
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() os.Error { return nil }
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, os.Error) {
+	if f.entries == nil {
+		return nil, os.ENOTDIR
+	}
+	return nextEntries(&f.entries, count)
+}
+
+// nextEntries returns the next count entries of *entries, or all of them if
+// count isn't positive, and drops them from it.  As with os.File.Readdir,
+// a positive count past the last entry gives os.EOF.
+func nextEntries(entries *[]os.FileInfo, count int) ([]os.FileInfo, os.Error) {
+	fis := *entries
+	if count > 0 {
+		if len(fis) == 0 {
+			return fis, os.EOF
+		}
+		if count < len(fis) {
+			fis = fis[0:count]
+		}
+	}
+	*entries = (*entries)[len(fis):]
+	return fis, nil
+}
+
+// Overlay returns a FileSystem whose files are those of upper, and those
+// of lower that upper doesn't have.  It lets local files override
+// embedded ones during development, as in
+//
+//	a.SetFileSystem(fastweb.Overlay(fastweb.OSFileSystem{}, embedded))
+func Overlay(upper, lower FileSystem) FileSystem {
+	return &overlayFS{upper, lower}
+}
+
+type overlayFS struct {
+	upper, lower FileSystem
+}
+
+func (o *overlayFS) Stat(name string) (*os.FileInfo, os.Error) {
+	if fi, e := o.upper.Stat(name); e == nil {
+		return fi, nil
+	}
+	return o.lower.Stat(name)
+}
+
+func (o *overlayFS) Open(name string) (File, os.Error) {
+	f, e := o.upper.Open(name)
+	if e != nil {
+		return o.lower.Open(name)
+	}
+	// a directory in both lists the entries of both
+	if fi, e := o.upper.Stat(name); e == nil && fi.IsDirectory() {
+		if lfi, e := o.lower.Stat(name); e == nil && lfi.IsDirectory() {
+			if lf, e := o.lower.Open(name); e == nil {
+				return &overlayDir{File: f, lower: lf}, nil
+			}
+		}
+	}
+	return f, nil
+}
+
+// overlayDir is a directory present in both file systems of an overlay.
+type overlayDir struct {
+	File
+	lower   File
+	merged  bool
+	entries []os.FileInfo // those left to read, once merged
+}
+
+func (d *overlayDir) Close() os.Error {
+	d.lower.Close()
+	return d.File.Close()
+}
+
+func (d *overlayDir) Readdir(count int) ([]os.FileInfo, os.Error) {
+	if !d.merged {
+		fis, e := d.merge()
+		if e != nil {
+			return nil, e
+		}
+		d.entries = fis
+		d.merged = true
+	}
+	return nextEntries(&d.entries, count)
+}
+
+// merge lists the entries of upper, then those of lower that upper doesn't
+// have.
+func (d *overlayDir) merge() ([]os.FileInfo, os.Error) {
+	fis, e := d.File.Readdir(-1)
+	if e != nil {
+		return nil, e
+	}
+	lfis, e := d.lower.Readdir(-1)
+	if e != nil {
+		return nil, e
+	}
+	seen := make(map[string]bool)
+	for _, fi := range fis {
+		seen[fi.Name] = true
+	}
+	for _, fi := range lfis {
+		if !seen[fi.Name] {
+			fis = append(fis, fi)
+		}
+	}
+	return fis, nil
+}
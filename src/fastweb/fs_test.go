@@ -0,0 +1,56 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"os"
+	"testing"
+)
+
+// readNames reads the entries of dir in fs two at a time, as long as
+// Readdir gives some, and checks that the end is reported as os.EOF.
+func readNames(t *testing.T, fs FileSystem, dir string) []string {
+	f, e := fs.Open(dir)
+	if e != nil {
+		t.Fatal(e.String())
+	}
+	defer f.Close()
+	var names []string
+	for {
+		fis, e := f.Readdir(2)
+		if len(fis) > 2 {
+			t.Errorf("Readdir(2) returned %d entries", len(fis))
+		}
+		for _, fi := range fis {
+			names = append(names, fi.Name)
+		}
+		if len(fis) == 0 {
+			if e != os.EOF {
+				t.Errorf("Readdir(2) at the end returned %v, want os.EOF", e)
+			}
+			return names
+		}
+	}
+	panic("unreachable")
+}
+
+func TestReaddirCount(t *testing.T) {
+	upper := NewMemFileSystem()
+	upper.Add("views/a.tpl", nil)
+	upper.Add("views/c.tpl", nil)
+	lower := NewMemFileSystem()
+	lower.Add("views/a.tpl", nil)
+	lower.Add("views/b.tpl", nil)
+	lower.Add("views/d/e.tpl", nil)
+
+	names := readNames(t, upper, "views")
+	if len(names) != 2 || names[0] != "a.tpl" || names[1] != "c.tpl" {
+		t.Errorf("memory file system lists %v", names)
+	}
+	names = readNames(t, Overlay(upper, lower), "views")
+	if len(names) != 4 || names[0] != "a.tpl" || names[1] != "c.tpl" || names[2] != "b.tpl" || names[3] != "d" {
+		t.Errorf("overlay lists %v", names)
+	}
+}
@@ -0,0 +1,645 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bufio"
+	"bytes"
+	"container/vector"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strings"
+)
+
+// Parser of multipart/form-data bodies as described by RFC 7578 (and the
+// MIME multipart syntax of RFC 2046 it builds on).
+
+const (
+	maxBoundaryLen    = 70
+	maxHeaderBytes    = 16 * 1024
+	maxBoundaryLine   = 1024
+	multipartBufSize  = 4096
+	errMultipartTrunc = "unexpected end of multipart body"
+)
+
+var crlf = []byte{'\r', '\n'}
+
+type multipartReader struct {
+	rd   io.Reader
+	bd   []byte // the delimiter: CRLF, "--" and the boundary
+	buf  []byte
+	head int
+	tail int
+	eof  bool
+	done bool
+}
+
+func newMultipartReader(rd io.Reader, bd string) *multipartReader {
+	md := &multipartReader{
+		rd:  rd,
+		bd:  []byte("\r\n--" + bd),
+		buf: make([]byte, multipartBufSize),
+	}
+	// The CRLF preceding a delimiter belongs to the delimiter, but the
+	// first boundary may start the body.  Pretend it is preceded by a CRLF
+	// so that it is matched like the others.
+	md.tail = copy(md.buf, crlf)
+	return md
+}
+
+// finished reports whether the close delimiter has been read.
+func (md *multipartReader) finished() bool { return md.done }
+
+// fill reads from the underlying reader until at least n bytes are
+// buffered or the input is exhausted.
+func (md *multipartReader) fill(n int) os.Error {
+	if md.head > 0 {
+		md.tail = copy(md.buf, md.buf[md.head:md.tail])
+		md.head = 0
+	}
+	for md.tail < n && !md.eof {
+		m, e := md.rd.Read(md.buf[md.tail:])
+		md.tail += m
+		if e == os.EOF {
+			md.eof = true
+		} else if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// read returns the next chunk of data before delim.  found reports whether
+// delim has been reached, in which case it is consumed too.  If the input
+// ends before delim, the remaining data is returned with an error.  The
+// chunk is only valid until the next call.  It returns as soon as some
+// data is buffered that can't be part of delim, without waiting for more.
+func (md *multipartReader) read(delim []byte) (b []byte, found bool, err os.Error) {
+	for {
+		if i := bytes.Index(md.buf[md.head:md.tail], delim); i >= 0 {
+			b = md.buf[md.head : md.head+i]
+			md.head += i + len(delim)
+			return b, true, nil
+		}
+
+		if md.eof {
+			b = md.buf[md.head:md.tail]
+			md.head = md.tail
+			return b, false, os.NewError(errMultipartTrunc)
+		}
+
+		if md.tail-md.head >= len(delim) {
+			break
+		}
+		if e := md.fill(md.tail - md.head + 1); e != nil {
+			return nil, false, e
+		}
+	}
+
+	// keep what could be the beginning of delim for the next call
+	stop := md.tail - (len(delim) - 1)
+	b = md.buf[md.head:stop]
+	md.head = stop
+	return b, false, nil
+}
+
+type byteConsumer func([]byte) os.Error
+
+// readUntil passes the data up to delim to f, and consumes delim.  It stops
+// at the first error returned by f.
+func (md *multipartReader) readUntil(delim []byte, f byteConsumer) os.Error {
+	for {
+		b, found, e := md.read(delim)
+		if len(b) > 0 {
+			if e := f(b); e != nil {
+				return e
+			}
+		}
+		if e != nil {
+			return e
+		}
+		if found {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readLine returns the next line, without its CRLF.  Lines longer than limit
+// bytes are an error.
+func (md *multipartReader) readLine(limit int) (string, os.Error) {
+	var line bytes.Buffer
+	e := md.readUntil(crlf, func(b []byte) os.Error {
+		if line.Len()+len(b) > limit {
+			return os.NewError("multipart line too long")
+		}
+		line.Write(b)
+		return nil
+	})
+	return line.String(), e
+}
+
+// readBoundaryLine reads what follows a delimiter: either "--" for the close
+// delimiter, after which the epilogue is ignored, or optional white space
+// and CRLF.
+func (md *multipartReader) readBoundaryLine() os.Error {
+	if e := md.fill(2); e != nil {
+		return e
+	}
+	if md.tail-md.head >= 2 && md.buf[md.head] == '-' && md.buf[md.head+1] == '-' {
+		md.done = true
+		return nil
+	}
+	line, e := md.readLine(maxBoundaryLine)
+	if e != nil {
+		return e
+	}
+	if strings.Trim(line, " \t") != "" {
+		return os.NewError("malformed multipart boundary line")
+	}
+	return nil
+}
+
+// readPreamble skips everything up to and including the first boundary
+// line.
+func (md *multipartReader) readPreamble() os.Error {
+	e := md.readUntil(md.bd, func(b []byte) os.Error { return nil })
+	if e != nil {
+		return e
+	}
+	return md.readBoundaryLine()
+}
+
+// readHeaders reads the header lines of a part up to the empty line ending
+// them.  Header names are canonicalized; obsolete folded lines are joined.
+func (md *multipartReader) readHeaders() (map[string]*hdrInfo, os.Error) {
+	hdrs := make(map[string]*hdrInfo)
+	add := func(line string) {
+		if hdr := parseHeader(line); hdr != nil {
+			hdrs[hdr.key] = hdr
+		}
+	}
+
+	var last string
+	left := maxHeaderBytes
+	for {
+		line, e := md.readLine(left)
+		if e != nil {
+			return nil, e
+		}
+		if line == "" {
+			break
+		}
+		left -= len(line)
+		if line[0] == ' ' || line[0] == '\t' {
+			if last != "" {
+				last += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		if last != "" {
+			add(last)
+		}
+		last = line
+	}
+	if last != "" {
+		add(last)
+	}
+	return hdrs, nil
+}
+
+// readPart passes the content of the current part to f, then reads the
+// boundary line following it.
+func (md *multipartReader) readPart(f byteConsumer) os.Error {
+	if e := md.readUntil(md.bd, f); e != nil {
+		return e
+	}
+	return md.readBoundaryLine()
+}
+
+// readBody returns the content of the current part as a string.
+func (md *multipartReader) readBody(limit int64) (string, os.Error) {
+	var buf bytes.Buffer
+	e := md.readPart(func(b []byte) os.Error {
+		if limit > 0 && int64(buf.Len()+len(b)) > limit {
+			return errTooLarge("form field", limit)
+		}
+		buf.Write(b)
+		return nil
+	})
+	return buf.String(), e
+}
+
+type hdrInfo struct {
+	key     string
+	val     string
+	raw     string
+	attribs map[string]string
+}
+
+// parseHeader parses a header line like
+//
+//	Content-Disposition: form-data; name="field"; filename="a.txt"
+//
+// The key is canonicalized and attribute names are lower-cased.  It returns
+// nil if line isn't a header.
+func parseHeader(line string) *hdrInfo {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return nil
+	}
+	key := strings.TrimSpace(line[0:colon])
+	if key == "" || strings.IndexAny(key, " \t") >= 0 {
+		return nil
+	}
+	raw := strings.TrimSpace(line[colon+1:])
+	params := splitParams(raw)
+	hdr := &hdrInfo{
+		key:     http.CanonicalHeaderKey(key),
+		val:     strings.TrimSpace(params[0]),
+		raw:     raw,
+		attribs: make(map[string]string),
+	}
+	for _, p := range params[1:] {
+		var name, value string
+		if eq := strings.Index(p, "="); eq >= 0 {
+			name, value = p[0:eq], p[eq+1:]
+		} else {
+			name = p
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			hdr.attribs[name] = unquote(strings.TrimSpace(value))
+		}
+	}
+	return hdr
+}
+
+// splitParams splits s at the semicolons that are not within a quoted
+// string.
+func splitParams(s string) []string {
+	var params []string
+	quoted, escaped := false, false
+	j := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			params = append(params, s[j:i])
+			j = i + 1
+		}
+	}
+	return append(params, s[j:])
+}
+
+// unquote removes the quotes around a quoted string.  Only \" and \\ are
+// taken as escapes, since browsers send Windows paths with plain
+// backslashes.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if strings.Index(s, "\\") < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+// decodeExtValue decodes an RFC 5987 extended value, charset'lang'value
+// with percent-encoded octets, as used by filename*.  Only the UTF-8 and
+// ISO-8859-1 charsets are supported.
+func decodeExtValue(s string) (string, bool) {
+	parts := strings.SplitN(s, "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	v := parts[2]
+	b := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '%' {
+			b = append(b, v[i])
+			continue
+		}
+		if i+2 >= len(v) || unhex(v[i+1]) < 0 || unhex(v[i+2]) < 0 {
+			return "", false
+		}
+		b = append(b, byte(unhex(v[i+1])<<4|unhex(v[i+2])))
+		i += 2
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "utf-8":
+		return string(b), true
+	case "iso-8859-1":
+		r := make([]int, len(b))
+		for i, c := range b {
+			r[i] = int(c)
+		}
+		return string(r), true
+	}
+	return "", false
+}
+
+// partFilename returns the file name given in the Content-Disposition of a
+// part, if it is a file.  filename* takes precedence over filename, and any
+// directory part sent by the client is dropped.
+func partFilename(cd *hdrInfo) (string, bool) {
+	name, ok := cd.attribs["filename"]
+	if v, ok2 := cd.attribs["filename*"]; ok2 {
+		if s, ok3 := decodeExtValue(v); ok3 {
+			name, ok = s, true
+		}
+	}
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, true
+}
+
+// readPartHeaders reads the headers of the next part, and returns them
+// along with the field name and, for a file, the file name.
+func (md *multipartReader) readPartHeaders() (hdrs map[string]*hdrInfo, name string, filename string, isFile bool, e os.Error) {
+	hdrs, e = md.readHeaders()
+	if e != nil {
+		return
+	}
+	cd, ok := hdrs["Content-Disposition"]
+	if !ok {
+		e = os.NewError("can't find Content-Disposition")
+		return
+	}
+	if strings.ToLower(cd.val) != "form-data" {
+		e = os.NewError("Content-Disposition of part is '" + cd.val + "', not form-data")
+		return
+	}
+	name, ok = cd.attribs["name"]
+	if !ok {
+		e = os.NewError("can't find attrib 'name' in Content-Disposition")
+		return
+	}
+	filename, isFile = partFilename(cd)
+	return
+}
+
+func partHeader(hdrs map[string]*hdrInfo) http.Header {
+	header := make(http.Header)
+	for k, h := range hdrs {
+		header.Add(k, h.raw)
+	}
+	return header
+}
+
+// multipartBoundary returns the boundary given in the Content-Type ct.
+func multipartBoundary(ct string) (string, os.Error) {
+	hdr := parseHeader("Content-Type: " + ct)
+	if hdr == nil {
+		return "", os.NewError("bad content type")
+	}
+	b, ok := hdr.attribs["boundary"]
+	if !ok || b == "" {
+		return "", os.NewError("can't find boundary in content type")
+	}
+	if len(b) > maxBoundaryLen {
+		return "", os.NewError("boundary in content type is too long")
+	}
+	return b, nil
+}
+
+func (a *Application) parseMultipartForm(m map[string]*vector.StringVector, u map[string]*vector.Vector, r *Request, body io.Reader) os.Error {
+	b, e := multipartBoundary(r.Header.Get("Content-Type"))
+	if e != nil {
+		return e
+	}
+	md := newMultipartReader(body, b)
+	if e := md.readPreamble(); e != nil {
+		return e
+	}
+	for parts := 0; !md.finished(); parts++ {
+		if a.MaxParts > 0 && parts >= a.MaxParts {
+			return NewError("RequestEntityTooLarge", fmt.Sprintf("multipart body has more than %d parts", a.MaxParts))
+		}
+		hdrs, name, filename, isFile, e := md.readPartHeaders()
+		if e != nil {
+			return e
+		}
+		if isFile {
+			vec, ok := u[name]
+			if !ok {
+				vec = new(vector.Vector)
+				u[name] = vec
+			}
+
+			file, e := tempfile(a.tempDir())
+			if e != nil {
+				return e
+			}
+			wr := bufio.NewWriter(file)
+			fname := file.Name()
+			var size int64
+			var sniff []byte
+			sum := sha1.New()
+			e = md.readPart(func(b []byte) os.Error {
+				size += int64(len(b))
+				if a.MaxFileSize > 0 && size > a.MaxFileSize {
+					return errTooLarge("uploaded file '"+filename+"'", a.MaxFileSize)
+				}
+				sum.Write(b)
+				if a.SniffUploads && len(sniff) < sniffLen {
+					n := sniffLen - len(sniff)
+					if n > len(b) {
+						n = len(b)
+					}
+					sniff = append(sniff, b[0:n]...)
+				}
+				_, e := wr.Write(b)
+				return e
+			})
+			if e == nil {
+				e = wr.Flush()
+			}
+			// to flush (system) buffer, re-open immediately
+			file.Close()
+			if e == nil {
+				file, e = os.Open(fname)
+			}
+			if e != nil {
+				removeTempFile(fname)
+				return e
+			}
+
+			header := partHeader(hdrs)
+			up := &Upload{
+				File:        file,
+				Filename:    filename,
+				ContentType: header.Get("Content-Type"),
+				Size:        size,
+				Header:      header,
+				Checksum:    hex.EncodeToString(sum.Sum()),
+				path:        fname,
+			}
+			if a.SniffUploads {
+				up.SniffedType = http.DetectContentType(sniff)
+			}
+			vec.Push(up)
+		} else {
+			vec, ok := m[name]
+			if !ok {
+				vec = new(vector.StringVector)
+				m[name] = vec
+			}
+			s, e := md.readBody(a.MaxFieldSize)
+			if e != nil {
+				return e
+			}
+			vec.Push(s)
+		}
+	}
+	return nil
+}
+
+// MultipartReader iterates over the parts of a multipart/form-data body
+// that hasn't been parsed by the framework, see Controller.ParseBody.
+type MultipartReader struct {
+	md       *multipartReader
+	started  bool
+	cur      *Part
+	parts    int
+	maxParts int
+}
+
+// Part is a part of a multipart/form-data body.  Its content is read
+// through Read.
+type Part struct {
+	Name     string
+	Filename string
+	IsFile   bool
+	Header   http.Header
+
+	md      *multipartReader
+	pending []byte
+	found   bool
+	err     os.Error
+}
+
+// MultipartReader returns an iterator over the parts of the body if the
+// request is a multipart/form-data one that wasn't parsed before the
+// action.
+func (c *Controller) MultipartReader() (*MultipartReader, os.Error) {
+	if c.BodyReader == nil {
+		return nil, os.NewError("request body is not available")
+	}
+	ct := c.Request.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "multipart/form-data") {
+		return nil, os.NewError("request body is '" + ct + "', not multipart/form-data")
+	}
+	b, e := multipartBoundary(ct)
+	if e != nil {
+		return nil, e
+	}
+	mr := &MultipartReader{md: newMultipartReader(c.BodyReader, b)}
+	if c.app != nil {
+		mr.maxParts = c.app.MaxParts
+	}
+	c.BodyReader = nil
+	return mr, nil
+}
+
+// NextPart returns the next part of the body, skipping what is left of the
+// previous one.  It returns os.EOF after the last part.
+func (mr *MultipartReader) NextPart() (*Part, os.Error) {
+	if mr.cur != nil {
+		buf := make([]byte, 1024)
+		for {
+			if _, e := mr.cur.Read(buf); e != nil {
+				if e != os.EOF {
+					return nil, e
+				}
+				break
+			}
+		}
+		mr.cur = nil
+	} else if !mr.started {
+		if e := mr.md.readPreamble(); e != nil {
+			return nil, e
+		}
+	}
+	mr.started = true
+
+	if mr.md.finished() {
+		return nil, os.EOF
+	}
+	if mr.maxParts > 0 && mr.parts >= mr.maxParts {
+		return nil, NewError("RequestEntityTooLarge", fmt.Sprintf("multipart body has more than %d parts", mr.maxParts))
+	}
+	mr.parts++
+
+	hdrs, name, filename, isFile, e := mr.md.readPartHeaders()
+	if e != nil {
+		return nil, e
+	}
+	mr.cur = &Part{
+		Name:     name,
+		Filename: filename,
+		IsFile:   isFile,
+		Header:   partHeader(hdrs),
+		md:       mr.md,
+	}
+	return mr.cur, nil
+}
+
+// Read reads the content of the part.  It returns os.EOF at the end of the
+// part.
+func (p *Part) Read(b []byte) (int, os.Error) {
+	for len(p.pending) == 0 {
+		switch {
+		case p.err != nil:
+			return 0, p.err
+		case p.found:
+			// the boundary line must only be read once the pending chunk,
+			// which points into the buffer, has been used
+			p.err = p.md.readBoundaryLine()
+			if p.err == nil {
+				p.err = os.EOF
+			}
+		default:
+			p.pending, p.found, p.err = p.md.read(p.md.bd)
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
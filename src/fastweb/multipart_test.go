@@ -0,0 +1,297 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"fmt"
+	"os"
+	"rand"
+	"strings"
+	"testing"
+)
+
+type testPart struct {
+	name     string
+	filename string
+	isFile   bool
+	hdrs     map[string]*hdrInfo
+	body     string
+}
+
+// parseBody parses a multipart body with the boundary bd into its parts,
+// as parseMultipartForm does.
+func parseBody(body, bd string) ([]*testPart, os.Error) {
+	md := newMultipartReader(strings.NewReader(body), bd)
+	if e := md.readPreamble(); e != nil {
+		return nil, e
+	}
+	var parts []*testPart
+	for !md.finished() {
+		hdrs, e := md.readHeaders()
+		if e != nil {
+			return parts, e
+		}
+		cd, ok := hdrs["Content-Disposition"]
+		if !ok || strings.ToLower(cd.val) != "form-data" {
+			return parts, os.NewError("no form-data Content-Disposition")
+		}
+		p := &testPart{hdrs: hdrs}
+		if p.name, ok = cd.attribs["name"]; !ok {
+			return parts, os.NewError("no name in Content-Disposition")
+		}
+		p.filename, p.isFile = partFilename(cd)
+		if p.body, e = md.readBody(0); e != nil {
+			return parts, e
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// checkParts reports the parts of a successful parse that aren't well
+// formed: a body can't hold the delimiter, nor a file name a directory.
+func checkParts(t *testing.T, what string, parts []*testPart) {
+	for i, p := range parts {
+		if strings.Contains(p.body, "\r\n--bd") {
+			t.Errorf("%s: part %d holds the delimiter: %q", what, i, p.body)
+		}
+		if p.isFile && strings.IndexAny(p.filename, "/\\") >= 0 {
+			t.Errorf("%s: file name of part %d has a directory: %q", what, i, p.filename)
+		}
+	}
+}
+
+type multipartTest struct {
+	what  string
+	body  string
+	parts []testPart // name, filename, isFile and body expected
+	err   bool
+}
+
+var multipartTests = []multipartTest{
+	{
+		"no leading CRLF",
+		"--bd\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nx\r\n--bd--\r\n",
+		[]testPart{{name: "a", body: "x"}},
+		false,
+	},
+	{
+		"preamble, padding and epilogue",
+		"ignored\r\n--bd \t\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nx\r\n" +
+			"--bd\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\ny\r\n--bd--\r\nignored too",
+		[]testPart{{name: "a", body: "x"}, {name: "b", body: "y"}},
+		false,
+	},
+	{
+		"header with no value",
+		"--bd\r\nContent-Disposition: form-data; name=\"a\"\r\nX-Empty:\r\n\r\nx\r\n--bd--",
+		[]testPart{{name: "a", body: "x"}},
+		false,
+	},
+	{
+		"lower-case and folded headers",
+		"--bd\r\ncontent-disposition: form-data;\r\n name=\"a\"\r\n\r\nx\r\n--bd--",
+		[]testPart{{name: "a", body: "x"}},
+		false,
+	},
+	{
+		"filename*",
+		"--bd\r\nContent-Disposition: form-data; name=\"f\"; filename=\"fallback.txt\"; " +
+			"filename*=UTF-8''%E2%82%AC%20rates.txt\r\n\r\ndata\r\n--bd--",
+		[]testPart{{name: "f", filename: "\u20ac rates.txt", isFile: true, body: "data"}},
+		false,
+	},
+	{
+		"client directory in filename",
+		"--bd\r\nContent-Disposition: form-data; name=\"f\"; filename=\"C:\\dir\\a.txt\"\r\n\r\ndata\r\n--bd--",
+		[]testPart{{name: "f", filename: "a.txt", isFile: true, body: "data"}},
+		false,
+	},
+	{
+		"delimiter-like content",
+		"--bd\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n--bd\r\n-x\r\n--bd--",
+		[]testPart{{name: "a", body: "--bd\r\n-x"}},
+		false,
+	},
+	{
+		"missing close delimiter",
+		"--bd\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nx",
+		nil,
+		true,
+	},
+	{
+		"missing close delimiter after a part",
+		"--bd\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nx\r\n--bd\r\n",
+		[]testPart{{name: "a", body: "x"}},
+		true,
+	},
+	{
+		"no boundary at all",
+		"Content-Disposition: form-data; name=\"a\"\r\n\r\nx",
+		nil,
+		true,
+	},
+	{
+		"LF line endings",
+		"--bd\nContent-Disposition: form-data; name=\"a\"\n\nx\n--bd--\n",
+		nil,
+		true,
+	},
+	{
+		"missing Content-Disposition",
+		"--bd\r\nContent-Type: text/plain\r\n\r\nx\r\n--bd--",
+		nil,
+		true,
+	},
+}
+
+func TestMultipartCorpus(t *testing.T) {
+	for _, test := range multipartTests {
+		parts, e := parseBody(test.body, "bd")
+		if test.err && e == nil {
+			t.Errorf("%s: no error", test.what)
+		}
+		if !test.err && e != nil {
+			t.Errorf("%s: %s", test.what, e)
+		}
+		if len(parts) != len(test.parts) {
+			t.Errorf("%s: %d parts, want %d", test.what, len(parts), len(test.parts))
+			continue
+		}
+		for i, p := range parts {
+			want := test.parts[i]
+			if p.name != want.name || p.filename != want.filename || p.isFile != want.isFile || p.body != want.body {
+				t.Errorf("%s: part %d is %q %q %v %q, want %q %q %v %q", test.what, i,
+					p.name, p.filename, p.isFile, p.body, want.name, want.filename, want.isFile, want.body)
+			}
+		}
+	}
+}
+
+func TestMultipartHeaderWithoutValue(t *testing.T) {
+	parts, e := parseBody(multipartTests[2].body, "bd")
+	if e != nil || len(parts) != 1 {
+		t.Fatalf("parse failed: %v", e)
+	}
+	h, ok := parts[0].hdrs["X-Empty"]
+	if !ok || h.val != "" {
+		t.Errorf("X-Empty header is %v, want an empty value", h)
+	}
+}
+
+func TestMultipartConsumerError(t *testing.T) {
+	errStop := os.NewError("stop")
+	body := "--bd\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n" +
+		strings.Repeat("x", 3*multipartBufSize) + "\r\n--bd--"
+	md := newMultipartReader(strings.NewReader(body), "bd")
+	if e := md.readPreamble(); e != nil {
+		t.Fatal(e.String())
+	}
+	if _, e := md.readHeaders(); e != nil {
+		t.Fatal(e.String())
+	}
+	calls := 0
+	e := md.readPart(func(b []byte) os.Error {
+		calls++
+		return errStop
+	})
+	if e != errStop {
+		t.Errorf("readPart returned %v, want the consumer's error", e)
+	}
+	if calls != 1 {
+		t.Errorf("consumer called %d times after failing", calls)
+	}
+
+	md = newMultipartReader(strings.NewReader(body), "bd")
+	md.readPreamble()
+	md.readHeaders()
+	if _, e := md.readBody(10); e == nil {
+		t.Errorf("readBody accepted a field over its limit")
+	}
+}
+
+// chunkReader returns its chunks one per Read, then fails as a connection
+// with nothing more to read would block.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, os.Error) {
+	if len(r.chunks) == 0 {
+		return 0, os.NewError("read past the data sent")
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestMultipartPartialRead(t *testing.T) {
+	md := newMultipartReader(&chunkReader{[]string{
+		"--bd\r\n",
+		"Content-Disposition: form-data; name=\"a\"\r\n\r\n",
+		"the beginning of a long upload",
+	}}, "bd")
+	if e := md.readPreamble(); e != nil {
+		t.Fatal(e.String())
+	}
+	if _, e := md.readHeaders(); e != nil {
+		t.Fatal(e.String())
+	}
+	b, found, e := md.read(md.bd)
+	if e != nil || found || len(b) == 0 {
+		t.Errorf("read waited for more data: %q, %v, %v", b, found, e)
+	}
+}
+
+// TestMultipartMutations parses damaged copies of the corpus, which must
+// either fail or give well formed parts.
+func TestMultipartMutations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, test := range multipartTests {
+		for i := 0; i < 200; i++ {
+			b := []byte(test.body)
+			for n := r.Intn(4) + 1; n > 0 && len(b) > 0; n-- {
+				switch j := r.Intn(len(b)); r.Intn(3) {
+				case 0:
+					b[j] = byte(r.Intn(256))
+				case 1:
+					b = append(b[0:j], b[j+1:]...)
+				default:
+					b = b[0:j]
+				}
+			}
+			if parts, e := parseBody(string(b), "bd"); e == nil {
+				checkParts(t, fmt.Sprintf("%s, mutated to %q", test.what, b), parts)
+			}
+		}
+	}
+}
+
+// Pieces random bodies are made of.
+var multipartPieces = []string{
+	"--bd", "--bd--", "\r\n", "\n", "--", "-", " ", "\t", "x", "\x00",
+	"Content-Disposition: form-data; name=\"a\"",
+	"Content-Disposition: form-data; name=\"f\"; filename=\"../a.txt\"",
+	"filename*=UTF-8''%E2%82", "Content-Type: text/plain", ":", ";", "\"",
+}
+
+// TestMultipartRandom parses bodies put together at random, which must
+// either fail or give well formed parts.
+func TestMultipartRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 5000; i++ {
+		var b []byte
+		for n := r.Intn(40); n > 0; n-- {
+			if r.Intn(8) == 0 {
+				b = append(b, byte(r.Intn(256)))
+			} else {
+				b = append(b, multipartPieces[r.Intn(len(multipartPieces))]...)
+			}
+		}
+		if parts, e := parseBody(string(b), "bd"); e == nil {
+			checkParts(t, fmt.Sprintf("%q", b), parts)
+		}
+	}
+}
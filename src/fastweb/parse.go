@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -49,8 +50,14 @@ var tab = []byte{'\t'}
 // The various types of "tokens", which are plain text or (usually) brace-delimited descriptors
 const (
 	tokAlternates = iota
+	tokBlock
 	tokComment
+	tokElif
+	tokElse
 	tokEnd
+	tokExtends
+	tokIf
+	tokInclude
 	tokLiteral
 	tokOr
 	tokRepeated
@@ -60,15 +67,34 @@ const (
 )
 
 // FormatterMap is the type describing the mapping from formatter
-// names to the functions that implement them.
+// names to the functions that implement them.  A formatter is passed the
+// invocation as its format parameter, arguments included, see
+// FormatterArgs.
 type FormatterMap map[string]func(io.Writer, string, ...interface{})
 
 // Built-in formatters.
 var builtins = FormatterMap{
-	"html": HTMLFormatter,
-	"json": JSONFormatter,
-	"str":  StringFormatter,
-	"":     StringFormatter,
+	"attr":      AttrFormatter,
+	"css":       CSSFormatter,
+	"currency":  CurrencyFormatter,
+	"date":      TimeFormatter,
+	"default":   DefaultFormatter,
+	"html":      HTMLFormatter,
+	"js":        JSFormatter,
+	"json":      JSONFormatter,
+	"lower":     LowerFormatter,
+	"nl2br":     Nl2brFormatter,
+	"number":    NumberFormatter,
+	"pluralize": PluralizeFormatter,
+	"raw":       StringFormatter,
+	"str":       StringFormatter,
+	"time":      TimeFormatter,
+	"title":     TitleFormatter,
+	"truncate":  TruncateFormatter,
+	"upper":     UpperFormatter,
+	"url":       URLFormatter,
+	"urlquery":  URLQueryFormatter,
+	"":          StringFormatter,
 }
 
 // The parsed state of a template is a vector of xxxElement structs.
@@ -89,6 +115,7 @@ type variableElement struct {
 	linenum int
 	args    []interface{} // The fields and literals in the invocation.
 	fmts    []string      // Names of formatters to apply. len(fmts) > 0
+	ctx     escContext    // How the output is escaped.
 }
 
 // A variableElement arg to be evaluated as a field name
@@ -110,17 +137,58 @@ type repeatedElement struct {
 	altend         int
 }
 
+// A .if block, with its .elif and .else blocks
+type ifElement struct {
+	linenum int           // of .if itself
+	conds   []interface{} // condition of each block, nil for .else
+	starts  []int         // first element of each block
+	end     int           // one beyond last element
+}
+
+// A .block, whose content a template extending this one can replace
+type blockElement struct {
+	linenum int       // of .block itself
+	name    string    // name of the block
+	start   int       // first element
+	end     int       // one beyond last element
+	esc     *escState // escaping context at the start of the block
+	endEsc  *escState // escaping context at its end
+}
+
+// An .include of another view
+type includeElement struct {
+	linenum int
+	name    string      // view to include, relative to the views root
+	arg     interface{} // expression giving the data of the view, nil for @
+	tmpl    *Template   // the view, once linked
+	esc     *escState   // escaping context of the .include, nil if none
+}
+
+// The content of a block, as defined in template t
+type blockRef struct {
+	t          *Template
+	start, end int
+}
+
 // Template is the type that represents a template definition.
 // It is unchanged after parsing.
 type Template struct {
-	fmap FormatterMap // formatters for variables
+	fmap  FormatterMap // formatters for variables
+	funcs FuncMap      // functions for expressions
+	file  string       // file the template was loaded from, if any
 	// Used during parsing:
-	ldelim, rdelim []byte // delimiters; default {}
-	buf            []byte // input text to process
-	p              int    // position in buf
-	linenum        int    // position in input
+	ldelim, rdelim []byte    // delimiters; default {}
+	buf            []byte    // input text to process
+	p              int       // position in buf
+	linenum        int       // position in input
+	escMode        int       // escaping mode; default EscapeNone
+	esc            *escState // escaping context at the end of the template
 	// Parsed results:
-	elems []interface{}
+	elems    []interface{}
+	parent   string                   // view named by .extends, "" if none
+	blocks   map[string]*blockRef     // blocks, with those of descendants once resolved
+	sites    map[string]*blockElement // where the blocks executed stand
+	includes []*includeElement        // views to link
 }
 
 // New creates a new template with the specified formatter map (which
@@ -391,13 +459,52 @@ func (t *Template) analyze(item []byte) (tok int, w []string) {
 		}
 		tok = tokAlternates
 		return
+	case ".if", ".elif":
+		if len(w) < 2 {
+			t.parseError("missing condition for %s: %s", first, item)
+			return
+		}
+		tok = tokIf
+		if first == ".elif" {
+			tok = tokElif
+		}
+		return
+	case ".else":
+		if len(w) != 1 {
+			t.parseError("incorrect fields for .else: %s", item)
+			return
+		}
+		tok = tokElse
+		return
+	case ".block":
+		if len(w) != 2 {
+			t.parseError("incorrect fields for .block: %s", item)
+			return
+		}
+		tok = tokBlock
+		return
+	case ".extends":
+		if len(w) != 2 {
+			t.parseError("incorrect fields for .extends: %s", item)
+			return
+		}
+		tok = tokExtends
+		return
+	case ".include":
+		if len(w) < 2 {
+			t.parseError("incorrect fields for .include: %s", item)
+			return
+		}
+		tok = tokInclude
+		return
 	}
 	t.parseError("bad directive: %s", item)
 	return
 }
 
-// formatter returns the Formatter with the given name in the Template, or nil if none exists.
-func (t *Template) formatter(name string) func(io.Writer, string, ...interface{}) {
+// formatter returns the Formatter invoked by f in the Template, or nil if none exists.
+func (t *Template) formatter(f string) func(io.Writer, string, ...interface{}) {
+	name := formatterName(f)
 	if t.fmap != nil {
 		if fn := t.fmap[name]; fn != nil {
 			return fn
@@ -408,9 +515,17 @@ func (t *Template) formatter(name string) func(io.Writer, string, ...interface{}
 
 // -- Parsing
 
-// newVariable allocates a new variable-evaluation element.
-func (t *Template) newVariable(words []string) *variableElement {
-	formatters := extractFormatters(words)
+// newVariable allocates a new variable-evaluation element for the
+// directive src.
+func (t *Template) newVariable(src string) *variableElement {
+	x, formatters := splitPipeline(src)
+	if isCall(x) {
+		return t.finishVariable([]interface{}{&exprArg{t.parseExpr(x)}}, formatters)
+	}
+	words := words([]byte(x))
+	if len(words) == 0 {
+		t.parseError("empty directive")
+	}
 	args := make([]interface{}, len(words))
 
 	// Build argument list, processing any literals
@@ -446,46 +561,119 @@ func (t *Template) newVariable(words []string) *variableElement {
 	// but it's more dynamic to let the user change the map contents underfoot.
 	// We do require the name to be present, though.
 
+	return t.finishVariable(args, formatters)
+}
+
+func (t *Template) finishVariable(args []interface{}, formatters []string) *variableElement {
 	// Is it in user-supplied map?
 	for _, f := range formatters {
 		if t.formatter(f) == nil {
-			t.parseError("unknown formatter: %q", f)
+			t.parseError("unknown formatter: %q", formatterName(f))
+		}
+		if _, e := parseFormatterArgs(f); e != nil {
+			t.parseError("bad arguments of formatter %q: %s", formatterName(f), e)
 		}
 	}
 
-	return &variableElement{t.linenum, args, formatters}
+	return &variableElement{linenum: t.linenum, args: args, fmts: formatters}
 }
 
-// extractFormatters extracts a list of formatters from words.
-// After the final space-separated argument in a variable, formatters may be
-// specified separated by pipe symbols. For example: {a b c|d|e}
-// The words parameter still has the formatters joined by '|' in the last word.
-// extractFormatters splits formatters, replaces the last word with the content
-// found before the first '|' within it, and returns the formatters obtained.
-// If no formatters are found in words, the default formatter is returned.
-func extractFormatters(words []string) (formatters []string) {
-	// "" is the default formatter.
-	formatters = []string{""}
-	if len(words) == 0 {
-		return
+// isCall reports whether the variable src calls a function, that is starts
+// with a name directly followed by a parenthesis, as in price(Total).  A
+// parenthesis elsewhere, as in Method:(arg), doesn't make a call.
+func isCall(src string) bool {
+	src = strings.TrimLeft(src, " \t\n\r")
+	i := 0
+	for i < len(src) && (src[i] == '_' || unicode.IsLetter(int(src[i])) || i > 0 && unicode.IsDigit(int(src[i]))) {
+		i++
 	}
-	var bar int
-	lastWord := words[len(words)-1]
-	if isQuote(lastWord[0]) {
-		end := endQuote([]byte(lastWord), 0)
-		if end < 0 || end+1 == len(lastWord) || lastWord[end+1] != '|' {
-			return
+	return i > 0 && i < len(src) && src[i] == '('
+}
+
+// splitPipeline splits a variable into its value and its formatters, which
+// follow the first "|" outside quotes and parentheses that isn't part of
+// "||".  For example: {a b c|d|e}.  If there are no formatters, the
+// default formatter "" is returned.
+func splitPipeline(src string) (x string, formatters []string) {
+	b := []byte(src)
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case isQuote(c):
+			if i = endQuote(b, i); i < 0 {
+				return src, []string{""}
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '|' && i+1 < len(b) && b[i+1] == '|':
+			i++
+		case c == '|' && depth == 0:
+			return src[0:i], splitOutsideQuotes(src[i+1:], '|')
 		}
-		bar = end + 1
-	} else {
-		bar = strings.IndexRune(lastWord, '|')
-		if bar < 0 {
-			return
+	}
+	return src, []string{""}
+}
+
+// splitOutsideQuotes splits s at the sep bytes that are not quoted, and
+// trims the spaces around the parts.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	b := []byte(s)
+	last := 0
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case isQuote(c):
+			if end := endQuote(b, i); end >= 0 {
+				i = end
+			}
+		case c == sep:
+			parts = append(parts, strings.TrimSpace(s[last:i]))
+			last = i + 1
 		}
 	}
-	words[len(words)-1] = lastWord[0:bar]
-	formatters = strings.Split(lastWord[bar+1:], "|")
-	return
+	return append(parts, strings.TrimSpace(s[last:]))
+}
+
+// formatterName returns the name of the formatter in the invocation f,
+// which may carry arguments, as in date:"2006-01-02".
+func formatterName(f string) string {
+	if i := strings.Index(f, ":"); i >= 0 {
+		return f[0:i]
+	}
+	return f
+}
+
+// FormatterArgs returns the arguments a formatter is invoked with: those
+// following a colon after its name in format, separated by commas.  Quoted
+// arguments are unquoted, as in
+//
+//	{Price|currency:"EUR",2}
+//
+// where the currency formatter gets "EUR" and "2".  Formatters taking
+// arguments call it with their format parameter.
+func FormatterArgs(format string) []string {
+	args, _ := parseFormatterArgs(format)
+	return args
+}
+
+func parseFormatterArgs(f string) ([]string, os.Error) {
+	i := strings.Index(f, ":")
+	if i < 0 {
+		return nil, nil
+	}
+	args := splitOutsideQuotes(f[i+1:], ',')
+	for j, arg := range args {
+		if arg != "" && isQuote(arg[0]) {
+			v, e := strconv.Unquote(arg)
+			if e != nil {
+				return nil, os.NewError("invalid literal: " + arg)
+			}
+			args[j] = v
+		}
+	}
+	return args, nil
 }
 
 // Grab the next item.  If it's simple, just append it to the template.
@@ -500,21 +688,31 @@ func (t *Template) parseSimple(item []byte) (done bool, tok int, w []string) {
 		t.elems = append(t.elems, &textElement{item})
 		return
 	case tokLiteral:
+		var text []byte
 		switch w[0] {
 		case ".meta-left":
-			t.elems = append(t.elems, &literalElement{t.ldelim})
+			text = t.ldelim
 		case ".meta-right":
-			t.elems = append(t.elems, &literalElement{t.rdelim})
+			text = t.rdelim
 		case ".space":
-			t.elems = append(t.elems, &literalElement{space})
+			text = space
 		case ".tab":
-			t.elems = append(t.elems, &literalElement{tab})
+			text = tab
 		default:
 			t.parseError("internal error: unknown literal: %s", w[0])
 		}
+		t.elems = append(t.elems, &literalElement{text})
 		return
 	case tokVariable:
-		t.elems = append(t.elems, t.newVariable(w))
+		t.elems = append(t.elems, t.newVariable(string(item[len(t.ldelim):len(item)-len(t.rdelim)])))
+		return
+	case tokInclude:
+		inc := &includeElement{linenum: t.linenum, name: t.viewName(w[1])}
+		if len(w) > 2 {
+			inc.arg = t.parseExpr(strings.Join(w[2:], " "))
+		}
+		t.elems = append(t.elems, inc)
+		t.includes = append(t.includes, inc)
 		return
 	}
 	return false, tok, w
@@ -557,6 +755,16 @@ Loop:
 			t.parseSection(w)
 		case tokRepeated:
 			t.parseRepeated(w)
+		case tokIf:
+			t.parseIf(w)
+		case tokBlock:
+			t.parseBlock(w)
+		case tokElif, tokElse:
+			t.parseError("%s not in .if", w[0])
+			break Loop
+		case tokExtends:
+			t.parseError(".extends must come first")
+			break Loop
 		case tokAlternates:
 			if r.altstart >= 0 {
 				t.parseError("extra .alternates in .repeated section")
@@ -611,6 +819,14 @@ Loop:
 			t.parseSection(w)
 		case tokRepeated:
 			t.parseRepeated(w)
+		case tokIf:
+			t.parseIf(w)
+		case tokBlock:
+			t.parseBlock(w)
+		case tokElif, tokElse:
+			t.parseError("%s not in .if", w[0])
+		case tokExtends:
+			t.parseError(".extends must come first")
 		case tokAlternates:
 			t.parseError(".alternates not in .repeated")
 		default:
@@ -621,6 +837,363 @@ Loop:
 	return s
 }
 
+func (t *Template) parseIf(words []string) *ifElement {
+	f := new(ifElement)
+	t.elems = append(t.elems, f)
+	f.linenum = t.linenum
+	f.conds = []interface{}{t.parseExpr(strings.Join(words[1:], " "))}
+	f.starts = []int{len(t.elems)}
+	// Scan blocks, starting a new one at each .elif and .else.
+Loop:
+	for {
+		item := t.nextItem()
+		if len(item) == 0 {
+			t.parseError("missing .end for .if")
+			break
+		}
+		done, tok, w := t.parseSimple(item)
+		if done {
+			continue
+		}
+		switch tok {
+		case tokEnd:
+			break Loop
+		case tokElif, tokElse:
+			if f.conds[len(f.conds)-1] == nil {
+				t.parseError("%s after .else", w[0])
+				break Loop
+			}
+			var cond interface{}
+			if tok == tokElif {
+				cond = t.parseExpr(strings.Join(w[1:], " "))
+			}
+			f.conds = append(f.conds, cond)
+			f.starts = append(f.starts, len(t.elems))
+		case tokSection:
+			t.parseSection(w)
+		case tokRepeated:
+			t.parseRepeated(w)
+		case tokIf:
+			t.parseIf(w)
+		case tokBlock:
+			t.parseBlock(w)
+		case tokOr:
+			t.parseError(".or in .if; use .else")
+		case tokExtends:
+			t.parseError(".extends must come first")
+		case tokAlternates:
+			t.parseError(".alternates not in .repeated")
+		default:
+			t.parseError("internal error: unknown .if item: %s", item)
+		}
+	}
+	f.end = len(t.elems)
+	return f
+}
+
+func (t *Template) parseBlock(words []string) *blockElement {
+	b := new(blockElement)
+	t.elems = append(t.elems, b)
+	b.linenum = t.linenum
+	b.name = words[1]
+	if _, dup := t.blocks[b.name]; dup {
+		t.parseError("block %s defined twice", b.name)
+	}
+	b.start = len(t.elems)
+Loop:
+	for {
+		item := t.nextItem()
+		if len(item) == 0 {
+			t.parseError("missing .end for .block %s", b.name)
+			break
+		}
+		done, tok, w := t.parseSimple(item)
+		if done {
+			continue
+		}
+		switch tok {
+		case tokEnd:
+			break Loop
+		case tokSection:
+			t.parseSection(w)
+		case tokRepeated:
+			t.parseRepeated(w)
+		case tokIf:
+			t.parseIf(w)
+		case tokBlock:
+			t.parseBlock(w)
+		case tokOr, tokElif, tokElse, tokAlternates:
+			t.parseError("%s not in a section or .if", w[0])
+		case tokExtends:
+			t.parseError(".extends must come first")
+		default:
+			t.parseError("internal error: unknown .block item: %s", item)
+		}
+	}
+	b.end = len(t.elems)
+	t.blocks[b.name] = &blockRef{t, b.start, b.end}
+	t.sites[b.name] = b
+	return b
+}
+
+// parseExtends records the view the template extends.  Only space may
+// precede it.
+func (t *Template) parseExtends(words []string) {
+	if t.parent != "" {
+		t.parseError("extra .extends")
+	}
+	for _, e := range t.elems {
+		if te, ok := e.(*textElement); !ok || len(strings.TrimSpace(string(te.text))) > 0 {
+			t.parseError(".extends must come first")
+		}
+	}
+	t.parent = t.viewName(words[1])
+}
+
+// viewName returns the name of a view given to .extends or .include,
+// which may be quoted.
+func (t *Template) viewName(word string) string {
+	if isQuote(word[0]) {
+		name, e := strconv.Unquote(word)
+		if e != nil {
+			t.parseError("invalid literal: %q: %s", word, e)
+		}
+		return name
+	}
+	return word
+}
+
+// Views returns the names of the views the template extends or includes,
+// which must be resolved and linked before it executes.
+func (t *Template) Views() []string {
+	var names []string
+	if t.parent != "" {
+		names = append(names, t.parent)
+	}
+	for _, inc := range t.includes {
+		names = append(names, inc.name)
+	}
+	return names
+}
+
+// Link makes the .include directives of name in t execute inc.  An
+// escaped view can only include escaped views, where the escaping context
+// is the one they start in, and end in: inside a <script> for a .js view,
+// in the text of the HTML for an .html one.
+func (t *Template) Link(name string, inc *Template) os.Error {
+	for _, e := range t.includes {
+		if e.name == name {
+			e.tmpl = inc
+			if err := e.check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check returns an error if the view inc includes can't be escaped where
+// it stands, as Link tells.
+func (inc *includeElement) check() os.Error {
+	it := inc.tmpl
+	if inc.esc == nil || it == nil {
+		return nil
+	}
+	var msg string
+	switch {
+	case it.escMode == EscapeNone:
+		msg = "view %s isn't escaped and can't be included in an escaped view"
+	case !newEscState(it.escMode).equal(inc.esc):
+		msg = "view %s is included in another context than it starts in"
+	case !it.esc.equal(inc.esc):
+		msg = "view %s ends in another context than it starts in"
+	default:
+		return nil
+	}
+	return &TemplateError{inc.linenum, fmt.Sprintf(msg, inc.name)}
+}
+
+// Resolve returns the template t describes once it extends parent: the
+// elements of parent, whose blocks execute the content t gives them, if
+// any.  parent must be resolved already.  The content of each block is
+// escaped in the context the block has in parent; it is an error for it
+// to end in a context other than the one the block ends in there.
+func (t *Template) Resolve(parent *Template) (*Template, os.Error) {
+	r := *parent
+	r.parent = t.parent
+	r.blocks = make(map[string]*blockRef)
+	for name, b := range parent.blocks {
+		r.blocks[name] = b
+	}
+	r.sites = make(map[string]*blockElement)
+	for name, b := range parent.sites {
+		r.sites[name] = b
+	}
+	// outer blocks first, which place the blocks nested in them
+	names := make([]string, 0, len(t.blocks))
+	for name := range t.blocks {
+		names = append(names, name)
+	}
+	sort.Sort(blocksByStart{names, t.blocks})
+	for _, name := range names {
+		b := t.blocks[name]
+		r.blocks[name] = b
+		site := r.sites[name]
+		if site == nil {
+			// not placed in parent, never executed
+			continue
+		}
+		var s *escState
+		if r.escMode != EscapeNone {
+			s = site.esc.clone()
+		}
+		if e := t.rescan(b.start, b.end, s, r.sites); e != nil {
+			return nil, e
+		}
+		if s != nil && !s.reconciles(site.endEsc) {
+			return nil, &TemplateError{t.sites[name].linenum,
+				fmt.Sprintf("content of block %s ends in another context than the block in the view it extends", name)}
+		}
+	}
+	return &r, nil
+}
+
+// rescan gives the elements start to end of t the escaping contexts they
+// have from s on, nil for no escaping, recording the blocks among them in
+// sites, and checks the views they include.  Each branch of a section is
+// scanned from the state the section starts in, and all must end in the
+// same state, which is where the section ends.
+func (t *Template) rescan(start, end int, s *escState, sites map[string]*blockElement) os.Error {
+	for i := start; i < end; i++ {
+		switch e := t.elems[i].(type) {
+		case *textElement:
+			if s != nil {
+				s.scan(e.text)
+			}
+		case *literalElement:
+			if s != nil {
+				s.scan(e.text)
+			}
+		case *variableElement:
+			e.ctx = escContext{}
+			if s != nil {
+				e.ctx = s.context()
+			}
+		case *blockElement:
+			if s != nil {
+				e.esc = s.clone()
+			}
+			if err := t.rescan(e.start, e.end, s, sites); err != nil {
+				return err
+			}
+			if s != nil {
+				e.endEsc = s.clone()
+			}
+			sites[e.name] = e
+			i = e.end - 1
+		case *includeElement:
+			e.esc = nil
+			if s != nil {
+				e.esc = s.clone()
+			}
+			if err := e.check(); err != nil {
+				return err
+			}
+		case *repeatedElement:
+			// items, alternates and .or each start and end where the
+			// section does, as it may repeat none of them or many
+			bodyEnd := e.end
+			if e.altstart >= 0 {
+				bodyEnd = e.altstart
+			} else if e.or >= 0 {
+				bodyEnd = e.or
+			}
+			bounds := []int{e.start, bodyEnd}
+			if e.altstart >= 0 {
+				bounds = append(bounds, e.altstart, e.altend)
+			}
+			if e.or >= 0 {
+				bounds = append(bounds, e.or, e.end)
+			}
+			if err := t.rescanBranches(s, sites, e.linenum, ".repeated", true, bounds); err != nil {
+				return err
+			}
+			i = e.end - 1
+		case *sectionElement:
+			bounds := []int{e.start, e.end}
+			if e.or >= 0 {
+				bounds = []int{e.start, e.or, e.or, e.end}
+			}
+			if err := t.rescanBranches(s, sites, e.linenum, ".section", e.or < 0, bounds); err != nil {
+				return err
+			}
+			i = e.end - 1
+		case *ifElement:
+			var bounds []int
+			for k, start := range e.starts {
+				end := e.end
+				if k+1 < len(e.starts) {
+					end = e.starts[k+1]
+				}
+				bounds = append(bounds, start, end)
+			}
+			noElse := e.conds[len(e.conds)-1] != nil
+			if err := t.rescanBranches(s, sites, e.linenum, ".if", noElse, bounds); err != nil {
+				return err
+			}
+			i = e.end - 1
+		}
+	}
+	return nil
+}
+
+// rescanBranches rescans the branches of a section, given by pairs of
+// start and end in bounds, each from s, and leaves s where they all end.
+// If the section may execute none of them, empty is set: they must end
+// where they start.
+func (t *Template) rescanBranches(s *escState, sites map[string]*blockElement, line int, what string, empty bool, bounds []int) os.Error {
+	var out *escState
+	if s != nil && empty {
+		out = s.clone()
+	}
+	for k := 0; k < len(bounds); k += 2 {
+		var b *escState
+		if s != nil {
+			b = s.clone()
+		}
+		if err := t.rescan(bounds[k], bounds[k+1], b, sites); err != nil {
+			return err
+		}
+		switch {
+		case b == nil:
+		case out == nil:
+			out = b
+		case !b.equal(out):
+			if empty {
+				return &TemplateError{line, fmt.Sprintf("%s section ends in another context than it starts in", what)}
+			}
+			return &TemplateError{line, fmt.Sprintf("branches of %s section end in different contexts", what)}
+		}
+	}
+	if out != nil {
+		*s = *out
+	}
+	return nil
+}
+
+// blocksByStart sorts names of blocks in the order they start.
+type blocksByStart struct {
+	names  []string
+	blocks map[string]*blockRef
+}
+
+func (b blocksByStart) Len() int      { return len(b.names) }
+func (b blocksByStart) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+
+func (b blocksByStart) Less(i, j int) bool {
+	return b.blocks[b.names[i]].start < b.blocks[b.names[j]].start
+}
+
 func (t *Template) parse() {
 	for {
 		item := t.nextItem()
@@ -632,12 +1205,18 @@ func (t *Template) parse() {
 			continue
 		}
 		switch tok {
-		case tokOr, tokEnd, tokAlternates:
+		case tokOr, tokEnd, tokAlternates, tokElif, tokElse:
 			t.parseError("unexpected %s", w[0])
 		case tokSection:
 			t.parseSection(w)
 		case tokRepeated:
 			t.parseRepeated(w)
+		case tokIf:
+			t.parseIf(w)
+		case tokBlock:
+			t.parseBlock(w)
+		case tokExtends:
+			t.parseExtends(w)
 		default:
 			t.parseError("internal error: bad directive in parse: %s", item)
 		}
@@ -662,7 +1241,13 @@ func (t *Template) Parse(s string) (err os.Error) {
 	t.buf = []byte(s)
 	t.p = 0
 	t.linenum = 1
+	t.blocks = make(map[string]*blockRef)
+	t.sites = make(map[string]*blockElement)
 	t.parse()
+	t.esc = newEscState(t.escMode)
+	if t.escMode != EscapeNone {
+		return t.rescan(0, len(t.elems), t.esc, t.sites)
+	}
 	return nil
 }
 
@@ -683,10 +1268,23 @@ func (t *Template) Execute(wr io.Writer, data interface{}) (err os.Error) {
 	val := reflect.ValueOf(data)
 	defer checkError(&err)
 	t.p = 0
-	t.execute(0, len(t.elems), &state{parent: nil, data: val, wr: wr})
+	t.execute(0, len(t.elems), &state{parent: nil, data: val, blocks: t.blocks, wr: wr})
 	return nil
 }
 
+// SetFuncs sets the functions the template can call.  It must be called
+// before Parse.
+func (t *Template) SetFuncs(funcs FuncMap) {
+	t.funcs = funcs
+}
+
+// SetEscapeMode sets how the variables of the template are escaped, one of
+// EscapeNone, EscapeHTML, EscapeJS and EscapeCSS.  It must be called before
+// Parse.
+func (t *Template) SetEscapeMode(mode int) {
+	t.escMode = mode
+}
+
 // SetDelims sets the left and right delimiters for operations in the
 // template.  They are validated during parsing.  They could be
 // validated here but it's better to keep the routine simple.  The
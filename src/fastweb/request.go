@@ -0,0 +1,251 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"http"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"url"
+)
+
+// Request is the protocol independent view of an incoming request that the
+// framework routes on.  Adapters build it from a FastCGI request or from a
+// http.Request; tests can build one with NewRequest.
+type Request struct {
+	Method     string
+	URL        *url.URL
+	Proto      string
+	Header     http.Header
+	Host       string
+	RemoteAddr string
+	Body       io.Reader
+
+	// Secure is set if the request arrived over TLS.
+	Secure bool
+
+	// Env holds the raw variables passed by the FastCGI front end.  It is
+	// nil for requests that did not arrive over FastCGI.
+	Env map[string]string
+}
+
+// NewRequest returns a Request for method and uri, suitable for passing to
+// Application.ServeRequest without a server.  body may be nil.
+func NewRequest(method string, uri string, body io.Reader) (*Request, os.Error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, e
+	}
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	return &Request{
+		Method: method,
+		URL:    u,
+		Proto:  "HTTP/1.1",
+		Header: make(http.Header),
+		Host:   u.Host,
+		Body:   body,
+	}, nil
+}
+
+func newFcgiRequest(p map[string]string, stdin io.Reader) (*Request, os.Error) {
+	uri, ok := p["REQUEST_URI"]
+	if !ok {
+		uri = p["SCRIPT_NAME"] + p["PATH_INFO"]
+	}
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, e
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = p["QUERY_STRING"]
+	}
+
+	header := make(http.Header)
+	for k, v := range p {
+		switch {
+		case k == "CONTENT_TYPE" || k == "CONTENT_LENGTH":
+		case strings.HasPrefix(k, "HTTP_"):
+			k = k[5:]
+		default:
+			continue
+		}
+		if v != "" {
+			header.Add(strings.Replace(k, "_", "-", -1), v)
+		}
+	}
+
+	return &Request{
+		Method:     p["REQUEST_METHOD"],
+		URL:        u,
+		Proto:      p["SERVER_PROTOCOL"],
+		Header:     header,
+		Host:       p["HTTP_HOST"],
+		RemoteAddr: p["REMOTE_ADDR"],
+		Body:       stdin,
+		Secure:     strings.ToLower(p["HTTPS"]) == "on" || p["REQUEST_SCHEME"] == "https",
+		Env:        p,
+	}, nil
+}
+
+// pathSegments returns the path of u split at its slashes, each segment
+// unescaped on its own, so that an escaped slash (%2F) stays within its
+// segment.  The first segment is the empty one before the leading slash.
+func pathSegments(u *url.URL) []string {
+	raw := u.RawPath
+	if i := strings.IndexAny(raw, "?#"); i >= 0 {
+		raw = raw[0:i]
+	}
+	if strings.HasPrefix(raw, "//") {
+		// after an authority
+		raw = raw[2:]
+		if i := strings.Index(raw, "/"); i >= 0 {
+			raw = raw[i:]
+		} else {
+			raw = ""
+		}
+	}
+	if !strings.HasPrefix(raw, "/") {
+		return strings.Split(u.Path, "/")
+	}
+	segs := strings.Split(raw, "/")
+	for i, seg := range segs {
+		// a + is itself in a path
+		if s, e := url.QueryUnescape(strings.Replace(seg, "+", "%2B", -1)); e == nil {
+			segs[i] = s
+		}
+	}
+	return segs
+}
+
+func newHTTPRequest(r *http.Request) *Request {
+	return &Request{
+		Method:     r.Method,
+		URL:        r.URL,
+		Proto:      r.Proto,
+		Header:     r.Header,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Body:       r.Body,
+		Secure:     r.TLS != nil,
+	}
+}
+
+// Header returns the value of the request header name, which is case
+// insensitive, or "" if there is none.
+func (c *Controller) Header(name string) string {
+	return c.Request.Header.Get(name)
+}
+
+func (c *Controller) UserAgent() string { return c.Request.Header.Get("User-Agent") }
+
+func (c *Controller) Referer() string { return c.Request.Header.Get("Referer") }
+
+// IsAjax reports whether the request was made by XMLHttpRequest, as told by
+// the X-Requested-With header most JavaScript libraries set.
+func (c *Controller) IsAjax() bool {
+	return c.Request.Header.Get("X-Requested-With") == "XMLHttpRequest"
+}
+
+func (c *Controller) isTrustedProxy(ip string) bool {
+	if c.app == nil {
+		return false
+	}
+	for _, p := range c.app.TrustedProxies {
+		if p == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort returns the host part of addr, which may or may not have a
+// port, without the brackets of an IPv6 address.
+func stripPort(addr string) string {
+	if host, _, e := net.SplitHostPort(addr); e == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// RemoteIP returns the IP address of the client.  If the request comes
+// from one of Application.TrustedProxies, the address is taken from
+// X-Forwarded-For: it is the last one in there not added by a trusted
+// proxy.
+func (c *Controller) RemoteIP() string {
+	ip := stripPort(c.Request.RemoteAddr)
+	if !c.isTrustedProxy(ip) {
+		return ip
+	}
+	fwd := strings.Split(strings.Join(c.Request.Header[http.CanonicalHeaderKey("X-Forwarded-For")], ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(fwd[i])
+		if addr == "" {
+			continue
+		}
+		ip = stripPort(addr)
+		if !c.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// IsSecure reports whether the request was made over TLS, either directly
+// or, according to X-Forwarded-Proto, to a trusted proxy.
+func (c *Controller) IsSecure() bool {
+	if c.Request.Secure {
+		return true
+	}
+	if c.isTrustedProxy(stripPort(c.Request.RemoteAddr)) {
+		return strings.ToLower(c.Request.Header.Get("X-Forwarded-Proto")) == "https"
+	}
+	return false
+}
+
+// Scheme returns "https" for secure requests, "http" otherwise.
+func (c *Controller) Scheme() string {
+	if c.IsSecure() {
+		return "https"
+	}
+	return "http"
+}
+
+func (c *Controller) hostPort() string {
+	if c.Request.Host != "" {
+		return c.Request.Host
+	}
+	if c.Request.Env != nil {
+		return c.Request.Env["SERVER_NAME"]
+	}
+	return ""
+}
+
+// Host returns the host name the request was made to, without the port.
+func (c *Controller) Host() string {
+	return stripPort(c.hostPort())
+}
+
+// Port returns the port the request was made to.
+func (c *Controller) Port() int {
+	if _, port, e := net.SplitHostPort(c.hostPort()); e == nil {
+		if n, e := strconv.Atoi(port); e == nil {
+			return n
+		}
+	}
+	if c.Request.Env != nil {
+		if n, e := strconv.Atoi(c.Request.Env["SERVER_PORT"]); e == nil {
+			return n
+		}
+	}
+	if c.IsSecure() {
+		return 443
+	}
+	return 80
+}
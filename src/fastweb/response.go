@@ -0,0 +1,209 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ResponseWriter is used by the framework to construct a response.  It has
+// the same method set as http.ResponseWriter, so the writer handed to
+// ServeHTTP is used directly.
+type ResponseWriter interface {
+	Header() http.Header
+	WriteHeader(status int)
+	Write(b []byte) (int, os.Error)
+}
+
+// fcgiResponseWriter writes a CGI style response (a Status header followed
+// by the other headers and the body) to the stdout stream of a FastCGI
+// request.
+type fcgiResponseWriter struct {
+	out         io.Writer
+	header      http.Header
+	wroteHeader bool
+}
+
+func newFcgiResponseWriter(out io.Writer) *fcgiResponseWriter {
+	return &fcgiResponseWriter{
+		out:    out,
+		header: make(http.Header),
+	}
+}
+
+func (w *fcgiResponseWriter) Header() http.Header { return w.header }
+
+func (w *fcgiResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if status != http.StatusOK {
+		fmt.Fprintf(w.out, "Status: %d %s\r\n", status, http.StatusText(status))
+	}
+	for k, v := range w.header {
+		for _, s := range v {
+			io.WriteString(w.out, k+": "+s+"\r\n")
+		}
+	}
+	io.WriteString(w.out, "\r\n")
+}
+
+func (w *fcgiResponseWriter) Write(b []byte) (int, os.Error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.out.Write(b)
+}
+
+// ResponseRecorder is a ResponseWriter that keeps the response in memory,
+// for exercising controllers without a server.
+type ResponseRecorder struct {
+	Code      int
+	HeaderMap http.Header
+	Body      *bytes.Buffer
+}
+
+// NewResponseRecorder returns an initialized ResponseRecorder.
+func NewResponseRecorder() *ResponseRecorder {
+	return &ResponseRecorder{
+		HeaderMap: make(http.Header),
+		Body:      new(bytes.Buffer),
+	}
+}
+
+func (rw *ResponseRecorder) Header() http.Header { return rw.HeaderMap }
+
+func (rw *ResponseRecorder) WriteHeader(status int) {
+	if rw.Code == 0 {
+		rw.Code = status
+	}
+}
+
+func (rw *ResponseRecorder) Write(b []byte) (int, os.Error) {
+	if rw.Code == 0 {
+		rw.Code = http.StatusOK
+	}
+	return rw.Body.Write(b)
+}
+
+type flusher interface {
+	Flush()
+}
+
+// responseBuffer is the ResponseWriter controllers write to.  It keeps the
+// status, the headers and the output until the action is over, so headers
+// can be changed all along and Content-Length can be sent, and so that an
+// error page replacing the response starts from none of them.  After Flush
+// it streams what is written straight to the client.
+type responseBuffer struct {
+	w         ResponseWriter
+	header    http.Header
+	buf       bytes.Buffer
+	status    int
+	committed bool
+	streaming bool
+
+	// before is called once, right before the header is sent.  It returns
+	// the status to send when WriteHeader has not been called.
+	before func() int
+}
+
+func newResponseBuffer(w ResponseWriter) *responseBuffer {
+	return &responseBuffer{w: w, header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if !b.committed {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, os.Error) {
+	if b.streaming {
+		return b.w.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Reset discards the output buffered so far.
+func (b *responseBuffer) Reset() {
+	b.buf.Reset()
+}
+
+// notModified turns the response into a 304 Not Modified, without body.
+func (b *responseBuffer) notModified() {
+	b.buf.Reset()
+	b.status = http.StatusNotModified
+}
+
+// settle calls before, once, and fixes the status.
+func (b *responseBuffer) settle() {
+	if b.before != nil {
+		s := b.before()
+		b.before = nil
+		if b.status == 0 {
+			b.status = s
+		}
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+}
+
+func (b *responseBuffer) commit() {
+	if b.committed {
+		return
+	}
+	b.committed = true
+	b.settle()
+	h := b.w.Header()
+	for k, v := range b.header {
+		h[k] = v
+	}
+	b.w.WriteHeader(b.status)
+}
+
+// Flush sends the header and the buffered output, and switches to
+// streaming.
+func (b *responseBuffer) Flush() {
+	b.commit()
+	b.streaming = true
+	if b.buf.Len() > 0 {
+		b.w.Write(b.buf.Bytes())
+		b.buf.Reset()
+	}
+	if f, ok := b.w.(flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends the response, with a Content-Length unless it has been
+// streamed.
+func (b *responseBuffer) finish() os.Error {
+	if b.streaming {
+		return nil
+	}
+	if !b.committed {
+		b.settle()
+		s := b.status
+		h := b.header
+		if h.Get("Content-Length") == "" && s >= 200 && s != http.StatusNoContent && s != http.StatusNotModified {
+			h.Set("Content-Length", strconv.Itoa(b.buf.Len()))
+		}
+	}
+	b.commit()
+	_, e := b.w.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return e
+}
@@ -0,0 +1,33 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"testing"
+)
+
+func TestResponseBufferHeader(t *testing.T) {
+	rec := NewResponseRecorder()
+	b := newResponseBuffer(rec)
+	b.Header().Set("ETag", `"1"`)
+	b.Write([]byte("page"))
+	if rec.HeaderMap.Get("ETag") != "" {
+		t.Error("header sent before the response")
+	}
+
+	// an error page replaces the response
+	eb := newResponseBuffer(rec)
+	eb.WriteHeader(500)
+	eb.Write([]byte("error"))
+	if e := eb.finish(); e != nil {
+		t.Fatal(e)
+	}
+	if rec.HeaderMap.Get("ETag") != "" {
+		t.Error("error page sent with the header of the response it replaces")
+	}
+	if rec.Code != 500 || rec.HeaderMap.Get("Content-Length") != "5" || rec.Body.String() != "error" {
+		t.Errorf("bad response %d %v %q", rec.Code, rec.HeaderMap, rec.Body.String())
+	}
+}
@@ -0,0 +1,212 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"http"
+	"net"
+	"os"
+	"rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run serves the application over FastCGI on addr, which is one of
+//
+//	host:port     a TCP address
+//	unix:/path    a Unix domain socket, created with SocketMode
+//	fd:N          a listening socket inherited as file descriptor N
+//	systemd       the first socket passed by systemd socket activation
+//
+// It returns nil once the application has been shut down by Shutdown,
+// which the signals package calls on SIGTERM or SIGINT.
+func (a *Application) Run(addr string) os.Error {
+	l, e := a.listen(addr)
+	if e != nil {
+		return e
+	}
+	return a.serve(l, true)
+}
+
+// RunListener serves the application over FastCGI on l.
+func (a *Application) RunListener(l net.Listener) os.Error {
+	return a.serve(l, true)
+}
+
+// RunHTTP serves the application over plain HTTP on addr, which takes the
+// same forms as for Run.
+func (a *Application) RunHTTP(addr string) os.Error {
+	l, e := a.listen(addr)
+	if e != nil {
+		return e
+	}
+	return a.serve(l, false)
+}
+
+// RunHTTPListener serves the application over plain HTTP on l.
+func (a *Application) RunHTTPListener(l net.Listener) os.Error {
+	return a.serve(l, false)
+}
+
+// The first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+func (a *Application) listen(addr string) (net.Listener, os.Error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return a.listenUnix(addr[5:])
+	case strings.HasPrefix(addr, "fd:"):
+		fd, e := strconv.Atoi(addr[3:])
+		if e != nil || fd < 0 {
+			return nil, os.NewError("bad file descriptor in address '" + addr + "'")
+		}
+		return fileListener(fd)
+	case addr == "systemd":
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if pid != os.Getpid() || n < 1 {
+			return nil, os.NewError("no socket passed by systemd")
+		}
+		os.Setenv("LISTEN_PID", "")
+		os.Setenv("LISTEN_FDS", "")
+		return fileListener(listenFdsStart)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (a *Application) listenUnix(path string) (net.Listener, os.Error) {
+	// remove a socket left behind by a previous run
+	if fi, e := os.Lstat(path); e == nil && fi.IsSocket() {
+		os.Remove(path)
+	}
+	l, e := net.Listen("unix", path)
+	if e != nil {
+		return nil, e
+	}
+	if e := os.Chmod(path, a.SocketMode); e != nil {
+		l.Close()
+		return nil, e
+	}
+	return l, nil
+}
+
+func fileListener(fd int) (net.Listener, os.Error) {
+	f := os.NewFile(fd, "fd:"+strconv.Itoa(fd))
+	if f == nil {
+		return nil, os.NewError("bad file descriptor " + strconv.Itoa(fd))
+	}
+	l, e := net.FileListener(f)
+	// the listener holds its own copy of the descriptor
+	f.Close()
+	return l, e
+}
+
+func (a *Application) serve(l net.Listener, useFcgi bool) os.Error {
+	a.lock.Lock()
+	if a.closing {
+		a.lock.Unlock()
+		l.Close()
+		return os.NewError("application is shut down")
+	}
+	a.listeners = append(a.listeners, l)
+	a.lock.Unlock()
+
+	rand.Seed(time.Nanoseconds())
+
+	var e os.Error
+	if useFcgi {
+		e = fcgiServe(l, a)
+	} else {
+		e = http.Serve(l, a)
+	}
+
+	a.lock.Lock()
+	closing := a.closing
+	a.lock.Unlock()
+	if closing {
+		// the listener was closed by Shutdown; wait until it is done
+		<-a.done
+		return nil
+	}
+	return e
+}
+
+// enter registers the start of a request.  It returns false if the
+// application has already been shut down.
+func (a *Application) enter() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return false
+	}
+	a.active++
+	return true
+}
+
+func (a *Application) leave() {
+	a.lock.Lock()
+	a.active--
+	if a.active == 0 && a.drained != nil {
+		close(a.drained)
+		a.drained = nil
+	}
+	a.lock.Unlock()
+}
+
+// Shutdown stops accepting new connections, waits up to timeout
+// nanoseconds for the requests in flight to finish, then flushes all open
+// sessions and removes the upload temp files left behind.  If it times
+// out, the temp files are removed only once the requests still running,
+// which may be reading them, are done.
+func (a *Application) Shutdown(timeout int64) os.Error {
+	a.lock.Lock()
+	if a.closing {
+		a.lock.Unlock()
+		return os.NewError("application is already shutting down")
+	}
+	a.closing = true
+	listeners := a.listeners
+	a.listeners = nil
+	var drained chan bool
+	if a.active > 0 {
+		drained = make(chan bool)
+		a.drained = drained
+	}
+	a.lock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	var err os.Error
+	if drained != nil {
+		select {
+		case <-drained:
+			drained = nil
+		case <-time.After(timeout):
+			err = os.NewError("timed out waiting for requests to finish")
+		}
+	}
+
+	a.lock.Lock()
+	a.closed = true
+	a.lock.Unlock()
+
+	if e := flushSessions(); e != nil && err == nil {
+		err = e
+	}
+	if drained == nil {
+		RemoveTempFiles()
+	} else {
+		go func() {
+			<-drained
+			RemoveTempFiles()
+		}()
+	}
+
+	close(a.done)
+	return err
+}
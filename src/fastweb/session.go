@@ -12,6 +12,7 @@ import (
 	"rand"
 	"reflect"
 	"strconv"
+	"sync"
 )
 
 var SessionFilePath = "/tmp"
@@ -410,6 +411,20 @@ type Session struct {
 }
 
 var sessions = make(map[string]*Session)
+var sessionsLock sync.Mutex
+
+// flushSessions writes all open sessions to their files.
+func flushSessions() os.Error {
+	var err os.Error
+	sessionsLock.Lock()
+	for _, s := range sessions {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	sessionsLock.Unlock()
+	return err
+}
 
 func GetSession(c *Controller) *Session {
 	var sid string
@@ -424,7 +439,9 @@ func GetSession(c *Controller) *Session {
 				break LOAD
 			}
 		}
+		sessionsLock.Lock()
 		s, _ := sessions[sid]
+		sessionsLock.Unlock()
 		if s != nil {
 			return s
 		}
@@ -453,7 +470,9 @@ func GetSession(c *Controller) *Session {
 		sid:  sid,
 		data: make(map[string]interface{}),
 	}
+	sessionsLock.Lock()
 	sessions[sid] = s
+	sessionsLock.Unlock()
 
 	c.SetCookieFull("fastweb_sessid", sid, nil, "", "", false, true)
 
@@ -0,0 +1,214 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type staticDir struct {
+	prefix string
+	dir    string
+}
+
+// ServeStatic serves the files under dir of the file system of the
+// application, see SetFileSystem, for request paths starting with
+// prefix, before any controller is routed.  It is meant for development, so
+// that an application can run without a front end web server.  Requests
+// for files that don't exist fall through to the controllers.
+func (a *Application) ServeStatic(prefix string, dir string) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	a.staticDirs = append(a.staticDirs, &staticDir{
+		prefix: prefix,
+		dir:    strings.TrimRight(dir, "/"),
+	})
+}
+
+// cleanStaticPath returns the file path p refers to relative to a static
+// directory, or "" if p tries to escape from it.
+func cleanStaticPath(p string) string {
+	if strings.IndexAny(p, "\\\x00") >= 0 {
+		return ""
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return ""
+		}
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+func (a *Application) serveStatic(w ResponseWriter, r *Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	for _, sd := range a.staticDirs {
+		if !strings.HasPrefix(r.URL.Path, sd.prefix) {
+			continue
+		}
+		name := cleanStaticPath(r.URL.Path[len(sd.prefix):])
+		if name == "" {
+			continue
+		}
+		fname := sd.dir + name
+		fi, e := a.fs.Stat(fname)
+		if e != nil || !fi.IsRegular() {
+			continue
+		}
+		file, e := a.fs.Open(fname)
+		if e != nil {
+			log.Printf("failed to open static file %s: %s", fname, e)
+			continue
+		}
+		serveFile(w, r, fname, file, fi)
+		file.Close()
+		return true
+	}
+
+	return false
+}
+
+func serveFile(w ResponseWriter, r *Request, fname string, file File, fi *os.FileInfo) {
+	h := w.Header()
+	mtime := fi.Mtime_ns / 1e9
+	etag := fmt.Sprintf("\"%x-%x\"", fi.Mtime_ns, fi.Size)
+
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", time.SecondsToUTC(mtime).Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+
+	if notModified(r, etag, mtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ct := mime.TypeByExtension(path.Ext(fi.Name))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h.Set("Content-Type", ct)
+
+	status := http.StatusOK
+	start, length := int64(0), fi.Size
+	if rng := r.Header.Get("Range"); rng != "" {
+		if ir := r.Header.Get("If-Range"); ir == "" || ir == etag {
+			var ok bool
+			start, length, ok = parseRange(rng, fi.Size)
+			if !ok {
+				h.Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if length != fi.Size {
+				status = http.StatusPartialContent
+				h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, fi.Size))
+			}
+		}
+	}
+
+	h.Set("Content-Length", strconv.Itoa64(length))
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if start > 0 {
+		if _, e := file.Seek(start, 0); e != nil {
+			log.Printf("failed to seek static file %s: %s", fname, e)
+			return
+		}
+	}
+	io.Copyn(w, file, length)
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since against the
+// validators of the response.  An empty etag or a zero mtime is not
+// compared.
+func notModified(r *Request, etag string, mtime int64) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == etag || tag == "W/"+etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && mtime > 0 {
+		t, e := time.Parse(http.TimeFormat, ims)
+		if e == nil && mtime <= t.Seconds() {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses a Range header holding a single byte range, and
+// returns the start and length of the range within a body of size bytes.
+// A syntactically valid but unsupported header, like one holding several
+// ranges, yields the whole body.
+func parseRange(s string, size int64) (start int64, length int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Index(s, ",") >= 0 {
+		return 0, size, true
+	}
+	spec := strings.SplitN(strings.TrimSpace(s[6:]), "-", 2)
+	if len(spec) != 2 {
+		return 0, size, true
+	}
+	first, last := strings.TrimSpace(spec[0]), strings.TrimSpace(spec[1])
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, e := strconv.Atoi64(last)
+		if e != nil {
+			return 0, size, true
+		}
+		if n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, e := strconv.Atoi64(first)
+	if e != nil {
+		return 0, size, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, e = strconv.Atoi64(last)
+		if e != nil || end < start {
+			return 0, size, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
@@ -0,0 +1,178 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"container/vector"
+	crand "crypto/rand"
+	"encoding/hex"
+	"http"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Upload is a file uploaded through a multipart form.  The content is kept
+// in a temp file which is removed when the request finishes, unless the
+// controller calls SaveTo or Keep.
+type Upload struct {
+	File     *os.File
+	Filename string
+
+	// ContentType is the type declared by the client, "" if none.
+	ContentType string
+	// SniffedType is the type detected from the content, if
+	// Application.SniffUploads is set.
+	SniffedType string
+	Size        int64
+	// Header holds all the headers of the part.
+	Header http.Header
+	// Checksum is the hex encoded SHA-1 of the content, computed while the
+	// file was received.
+	Checksum string
+
+	path string
+	keep bool
+}
+
+// The number of bytes considered when sniffing the type of an upload.
+const sniffLen = 512
+
+// Keep stops the temp file of u, u.File.Name(), from being removed when the
+// request finishes.  The caller becomes responsible for removing it.
+func (u *Upload) Keep() {
+	u.keep = true
+	forgetTempFile(u.path)
+}
+
+// SaveTo moves the uploaded file to path, which is kept when the request
+// finishes.  Afterwards u.File refers to the file at path.
+func (u *Upload) SaveTo(path string) os.Error {
+	if e := os.Rename(u.path, path); e != nil {
+		// most likely on different file systems; copy it instead
+		if e := copyFile(u.File, path); e != nil {
+			return e
+		}
+		os.Remove(u.path)
+	}
+	forgetTempFile(u.path)
+	u.keep = true
+
+	file, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	u.File.Close()
+	u.File = file
+	u.path = path
+	return nil
+}
+
+func copyFile(src *os.File, path string) os.Error {
+	if _, e := src.Seek(0, 0); e != nil {
+		return e
+	}
+	dst, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if e != nil {
+		return e
+	}
+	_, e = io.Copy(dst, src)
+	if e1 := dst.Close(); e == nil {
+		e = e1
+	}
+	if e != nil {
+		os.Remove(path)
+	}
+	return e
+}
+
+// cleanupUploads closes the files of the uploads of a finished request and
+// removes those that weren't kept.
+func cleanupUploads(upload map[string][]*Upload) {
+	for _, v := range upload {
+		for _, u := range v {
+			u.File.Close()
+			if !u.keep {
+				removeTempFile(u.path)
+			}
+		}
+	}
+}
+
+// discardUploads removes the temp files of uploads parsed so far.
+func discardUploads(u map[string]*vector.Vector) {
+	for _, vec := range u {
+		for _, x := range *vec {
+			up := x.(*Upload)
+			up.File.Close()
+			removeTempFile(up.path)
+		}
+	}
+}
+
+// tempFiles records the upload temp files created by tempfile, so that the
+// leftovers can be removed on shutdown.
+var tempFiles = make(map[string]bool)
+var tempFilesLock sync.Mutex
+
+// RemoveTempFiles deletes the upload temp files still on disk.  Shutdown
+// calls it; a program exiting without a shutdown should too.
+func RemoveTempFiles() {
+	tempFilesLock.Lock()
+	for name := range tempFiles {
+		if e := os.Remove(name); e != nil {
+			log.Printf("failed to remove temp file: %s", e.String())
+		}
+		tempFiles[name] = false, false
+	}
+	tempFilesLock.Unlock()
+}
+
+// removeTempFile deletes a file created by tempfile.
+func removeTempFile(name string) {
+	os.Remove(name)
+	forgetTempFile(name)
+}
+
+func forgetTempFile(name string) {
+	tempFilesLock.Lock()
+	tempFiles[name] = false, false
+	tempFilesLock.Unlock()
+}
+
+// tempDir returns the directory upload temp files are created in.
+func (a *Application) tempDir() string {
+	if a.TempDir != "" {
+		return a.TempDir
+	}
+	if tmpdir := os.Getenv("TMPDIR"); tmpdir != "" {
+		return tmpdir
+	}
+	return "/tmp"
+}
+
+func tempfile(tmpdir string) (*os.File, os.Error) {
+	b := make([]byte, 10)
+	for {
+		if _, e := io.ReadFull(crand.Reader, b); e != nil {
+			return nil, e
+		}
+		// hex keeps every name equally likely
+		file, e := os.OpenFile(tmpdir+"/fastweb."+hex.EncodeToString(b), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if e == nil {
+			tempFilesLock.Lock()
+			tempFiles[file.Name()] = true
+			tempFilesLock.Unlock()
+			return file, e
+		}
+		pe, ok := e.(*os.PathError)
+		if !ok || pe.Error != os.EEXIST {
+			return nil, e
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package fastweb
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// How views are reloaded.
+const (
+	viewsChecked   = iota // the files are checked on every render
+	viewsPreloaded        // all views are loaded once, never reloaded
+	viewsWatched          // the files are polled in the background
+)
+
+// SetViewsRoot makes dir the directory views are read from, "views" by
+// default.  Templates loaded so far are dropped.
+func (a *Application) SetViewsRoot(dir string) {
+	for len(dir) > 1 && strings.HasSuffix(dir, "/") {
+		dir = dir[0 : len(dir)-1]
+	}
+	a.tmplLock.Lock()
+	a.viewsRoot = dir
+	a.tmplCache = make(map[string]*tmplInfo)
+	a.tmplLock.Unlock()
+}
+
+// PreloadViews loads and parses every view under the views root, for
+// production.  It returns the first error found, so that the application
+// can refuse to start with a broken view.  From then on the files are no
+// longer checked for changes.
+func (a *Application) PreloadViews() os.Error {
+	a.tmplLock.Lock()
+	defer a.tmplLock.Unlock()
+	a.tmplCache = make(map[string]*tmplInfo)
+	loaded := make(map[string]*tmplInfo)
+	e := walkViews(a.fs, a.viewsRoot, func(fname string) os.Error {
+		_, e := a.loadTemplateChain(fname, nil, loaded)
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	a.tmplCache = loaded
+	a.viewMode = viewsPreloaded
+	return nil
+}
+
+// WatchViews polls the files of the loaded views every interval
+// nanoseconds, for development.  Templates whose files changed or
+// disappeared are dropped, to be loaded again when next rendered; renders
+// no longer check the files themselves.  Polling stops when the
+// application is shut down.
+func (a *Application) WatchViews(interval int64) {
+	a.tmplLock.Lock()
+	watching := a.viewMode == viewsWatched
+	a.viewMode = viewsWatched
+	a.tmplLock.Unlock()
+	if !watching {
+		go a.watchViews(interval)
+	}
+}
+
+func (a *Application) watchViews(interval int64) {
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-time.After(interval):
+		}
+		a.tmplLock.Lock()
+		for fname, ti := range a.tmplCache {
+			if ti.stale(a.fs) {
+				log.Printf("view %s changed, reloading", fname)
+				a.tmplCache[fname] = nil, false
+			}
+		}
+		a.tmplLock.Unlock()
+	}
+}
+
+// walkViews calls fn with the file of each view under dir in fs.
+func walkViews(fs FileSystem, dir string, fn func(fname string) os.Error) os.Error {
+	f, e := fs.Open(dir)
+	if e != nil {
+		return e
+	}
+	fis, e := f.Readdir(-1)
+	f.Close()
+	if e != nil {
+		return e
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name, ".") {
+			continue
+		}
+		fname := dir + "/" + fi.Name
+		switch {
+		case fi.IsDirectory():
+			e = walkViews(fs, fname, fn)
+		case strings.HasSuffix(fi.Name, ".tpl"):
+			e = fn(fname)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// vim: set syntax=go autoindent:
+// Copyright 2010 Ivan Wong. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package signals shuts a fastweb application down on SIGTERM or SIGINT.
+//
+// Once os/signal is imported, which this package does, every signal is
+// delivered on signal.Incoming instead of having its default effect.  That
+// is why this is not part of fastweb itself: only the programs importing
+// it have their signals taken over.
+package signals
+
+import (
+	"go-fastweb.googlecode.com/svn/trunk/src/fastweb"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Handle starts a goroutine that shuts a down on SIGTERM or SIGINT, waiting
+// up to a.ShutdownTimeout for the requests in flight, and exits at once on
+// a second one, for a shutdown that takes too long.  The other signals have
+// their default effect: the process ignores, stops or exits on them.
+func Handle(a *fastweb.Application) {
+	go handle(a)
+}
+
+func handle(a *fastweb.Application) {
+	closing := false
+	for sig := range signal.Incoming {
+		usig, ok := sig.(os.UnixSignal)
+		if !ok {
+			continue
+		}
+		switch usig {
+		case os.SIGTERM, os.SIGINT:
+			if closing {
+				log.Printf("received %s again, exiting", sig)
+				exit(usig)
+			}
+			closing = true
+			log.Printf("received %s, shutting down", sig)
+			go func() {
+				if e := a.Shutdown(a.ShutdownTimeout); e != nil {
+					log.Printf("%s", e.String())
+				}
+			}()
+		case os.SIGCHLD, os.SIGCONT, os.SIGURG, os.SIGWINCH:
+			// ignored by default
+		case os.SIGTSTP, os.SIGTTIN, os.SIGTTOU:
+			syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+		default:
+			log.Printf("received %s, exiting", sig)
+			exit(usig)
+		}
+	}
+}
+
+// exit ends the process with the status a shell gives to one killed by sig.
+func exit(sig os.UnixSignal) {
+	fastweb.RemoveTempFiles()
+	os.Exit(128 + int(sig))
+}